@@ -0,0 +1,256 @@
+// monoctl monoの管理用APIを叩くCLI
+//
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] purge -bucket BUCKET [-blob BLOB | -prefix PREFIX]
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] prefetch [-f FILE] [-wait]
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] job ID
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] cancel ID
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] pin -bucket BUCKET (-blob BLOB | -prefix PREFIX)
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] unpin -bucket BUCKET (-blob BLOB | -prefix PREFIX)
+//	monoctl [-addr http://localhost:1324] [-token TOKEN] pins
+//
+// トークンは環境変数 MONO_ADMIN_TOKEN でも渡せる
+// monoの設定ファイルを読まずに動くよう、configなどmono本体のパッケージはimportしない
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `usage: monoctl [-addr URL] [-token TOKEN] <command> [options]
+
+commands:
+  purge -bucket BUCKET [-blob BLOB | -prefix PREFIX]
+      blobのキャッシュを加工済みの画像と一緒に消す
+      -prefix ならblob名がそれで始まるもの、どちらも無ければbucketの全てを消す
+  prefetch [-f FILE] [-wait]
+      FILE (省略時は標準入力) の1行ごとに "bucket/blob [variant ...]" を読んで先読みし、ジョブIDを出力する
+      variantはURLの1段目と同じ書き方 (例: w=400 w=200,h=200.webp)
+      -wait なら終わるまで待って結果を出力する
+  job ID
+      先読みのジョブの進み具合を出力する
+  cancel ID
+      先読みのジョブを止める
+  pin -bucket BUCKET (-blob BLOB | -prefix PREFIX)
+      blobを固定して先読みする 固定したものは消されない
+  unpin -bucket BUCKET (-blob BLOB | -prefix PREFIX)
+      pinで固定したものを外す 設定ファイルで固定したものは外せない
+  pins
+      固定しているものの一覧を出力する
+`
+
+var (
+	addr  = flag.String("addr", "http://localhost:1324", "管理用エンドポイントのURL")
+	token = flag.String("token", os.Getenv("MONO_ADMIN_TOKEN"), "admin.tokenに設定したトークン")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "purge":
+		err = purge(flag.Args()[1:])
+	case "prefetch":
+		err = prefetch(flag.Args()[1:])
+	case "job":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = printResponse(http.MethodGet, "/prefetch/"+flag.Arg(1), nil)
+	case "cancel":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		_, err = request(http.MethodDelete, "/prefetch/"+flag.Arg(1), nil)
+	case "pin":
+		err = pin(http.MethodPost, flag.Args()[1:])
+	case "unpin":
+		err = pin(http.MethodDelete, flag.Args()[1:])
+	case "pins":
+		err = printResponse(http.MethodGet, "/pins", nil)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "monoctl:", err)
+		os.Exit(1)
+	}
+}
+
+func purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	bucket := fs.String("bucket", "", "bucket名")
+	blob := fs.String("blob", "", "消すblob名")
+	prefix := fs.String("prefix", "", "消すblob名のprefix")
+	fs.Parse(args)
+	if *bucket == "" || (*blob != "" && *prefix != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return printResponse(http.MethodPost, "/purge", map[string]string{
+		"bucket": *bucket,
+		"blob":   *blob,
+		"prefix": *prefix,
+	})
+}
+
+func pin(method string, args []string) error {
+	fs := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	bucket := fs.String("bucket", "", "bucket名")
+	blob := fs.String("blob", "", "blob名")
+	prefix := fs.String("prefix", "", "blob名のprefix")
+	fs.Parse(args)
+	if *bucket == "" || (*blob == "") == (*prefix == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return printResponse(method, "/pins", map[string]string{
+		"bucket": *bucket,
+		"blob":   *blob,
+		"prefix": *prefix,
+	})
+}
+
+type prefetchEntry struct {
+	Bucket   string   `json:"bucket"`
+	Blob     string   `json:"blob"`
+	Variants []string `json:"variants"`
+}
+
+type prefetchJob struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	Total     int    `json:"total"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+}
+
+func prefetch(args []string) error {
+	fs := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	file := fs.String("f", "", "先読みするblobの一覧のファイル 省略時は標準入力")
+	wait := fs.Bool("wait", false, "終わるまで待つ")
+	fs.Parse(args)
+
+	in := os.Stdin
+	if *file != "" {
+		fp, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		in = fp
+	}
+	entries := []prefetchEntry{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		i := strings.Index(fields[0], "/")
+		if i <= 0 || i == len(fields[0])-1 {
+			return fmt.Errorf("invalid entry: %q", scanner.Text())
+		}
+		entries = append(entries, prefetchEntry{
+			Bucket:   fields[0][:i],
+			Blob:     fields[0][i+1:],
+			Variants: fields[1:],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	body, err := request(http.MethodPost, "/prefetch", map[string]interface{}{"entries": entries})
+	if err != nil {
+		return err
+	}
+	var job prefetchJob
+	if err := json.Unmarshal(body, &job); err != nil {
+		return err
+	}
+	if !*wait {
+		fmt.Println(job.ID)
+		return nil
+	}
+	for {
+		time.Sleep(time.Second)
+		body, err := request(http.MethodGet, "/prefetch/"+job.ID, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &job); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d (failed %d)", job.ID, job.Succeeded+job.Failed, job.Total, job.Failed)
+		if job.State != "running" {
+			fmt.Fprintln(os.Stderr)
+			fmt.Println(string(bytes.TrimSpace(body)))
+			return nil
+		}
+	}
+}
+
+// 返ってきたJSONをそのまま出力する
+func printResponse(method string, path string, body interface{}) error {
+	respBody, err := request(method, path, body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes.TrimSpace(respBody)))
+	return nil
+}
+
+// bodyがあればJSONにして送り、レスポンスのbodyを返す
+func request(method string, path string, body interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, *addr+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(respBody))
+	}
+	return respBody, nil
+}
@@ -5,29 +5,137 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"testing"
 
 	"github.com/nerikeshi-k/mono/util"
+	"golang.org/x/exp/slices"
 )
 
 var config Config
 
 // Config 設定ファイル
 type Config struct {
-	Port               int64  `json:"port"`
-	CacheDirPath       string `json:"cache_volume_path"`
-	CacheControlHeader string `json:"cache_control_header"`
-	RecordStoreDirPath string `json:"record_store_volume_path"`
-	CacheExpires       int64  `json:"cache_expires"`
-	MaxCacheVolume     int64  `json:"max_cache_volume"`
-	Buckets            []struct {
-		Name string `json:"name"`
-	} `json:"buckets"`
-	Collect struct {
-		Span int64 `json:"span"`
+	Port                 int64    `json:"port"`
+	CacheDirPath         string   `json:"cache_volume_path"`
+	CacheControlHeader   string   `json:"cache_control_header"`
+	RecordStoreDirPath   string   `json:"record_store_volume_path"`
+	CacheExpires         int64    `json:"cache_expires"`
+	CacheRetention       int64    `json:"cache_retention"`        // 期限切れ後もoriginへの再検証のためにRecordを残しておく秒数
+	StaleWhileRevalidate int64    `json:"stale_while_revalidate"` // 期限切れ後この秒数の間は期限切れのものを返しつつ裏で取得し直す
+	StaleIfError         int64    `json:"stale_if_error"`         // 期限切れ後この秒数の間はoriginから取れなければ期限切れのものを返す
+	NegativeCacheExpires int64    `json:"negative_cache_expires"` // originに無かったことを覚えておく秒数 0なら覚えない
+	MaxCacheVolume       int64    `json:"max_cache_volume"`
+	MaxBlobSize          int64    `json:"max_blob_size"`     // キャッシュするblobの最大バイト数 0なら無制限
+	MaxPinnedVolume      int64    `json:"max_pinned_volume"` // 固定したキャッシュの容量(MB)の上限 max_cache_volumeとは別に数える 0なら無制限
+	Pins                 []Pin    `json:"pins"`
+	Buckets              []Bucket `json:"buckets"`
+	Routes               []Route  `json:"routes"`
+	Collect              struct {
+		Span               int64   `json:"span"`
+		HighWatermark      float64 `json:"high_watermark"`       // キャッシュの容量がmax_cache_volumeのこの割合を超えたら追い出しを始める 0なら0.9
+		LowWatermark       float64 `json:"low_watermark"`        // この割合を下回るまで追い出す 0なら0.8
+		ReconcileRateLimit float64 `json:"reconcile_rate_limit"` // 起動時の突き合わせで1秒あたりに確かめるレコードとファイルの数 0なら1000
 	} `json:"collect"`
+	Timeouts struct {
+		OriginFetch int64 `json:"origin_fetch"` // originからの取得のタイムアウト秒数 0なら無制限
+		Transform   int64 `json:"transform"`    // 画像加工のタイムアウト秒数 0なら無制限
+	} `json:"timeouts"`
+	Retry struct {
+		MaxAttempts    int64 `json:"max_attempts"`    // 1回目を含む試行回数 0なら3
+		InitialBackoff int64 `json:"initial_backoff"` // 最初のリトライまでの最大待ち時間(ミリ秒) 0なら100
+		MaxBackoff     int64 `json:"max_backoff"`     // リトライまでの待ち時間の上限(ミリ秒) 0なら2000
+	} `json:"retry"`
+	Breaker struct {
+		FailureThreshold int64 `json:"failure_threshold"` // 連続でこの回数失敗したbucketへの取得を止める 0なら無効
+		OpenDuration     int64 `json:"open_duration"`     // 取得を止める秒数 0なら30
+	} `json:"breaker"`
+	Admin struct {
+		Port  int64  `json:"port"`  // 管理用のポート 0なら開かない
+		Token string `json:"token"` // purgeなど更新系のAPIに必要なBearerトークン 空なら更新系のAPIは開かない
+	} `json:"admin"`
+	HotCache struct {
+		MaxVolume int64 `json:"max_volume"` // メモリに載せておくキャッシュの容量(MB) 0なら使わない
+	} `json:"hot_cache"`
+	Integrity struct {
+		SampleRate float64 `json:"sample_rate"` // ディスクから読んだキャッシュファイルのchecksumを確かめる割合 0なら1(全て)
+	} `json:"integrity"`
+	Prefetch struct {
+		Concurrency int64   `json:"concurrency"` // 先読みで同時に取得・加工する数 0なら4
+		RateLimit   float64 `json:"rate_limit"`  // 先読みで1秒あたりに取得・加工する数の上限 0なら無制限
+	} `json:"prefetch"`
+	HTTPOrigin struct {
+		AllowedHosts []string `json:"allowed_hosts"` // type "http"のbucketがアクセスしてよいホスト
+		MaxBodySize  int64    `json:"max_body_size"` // 取得するbodyの最大バイト数 0なら無制限
+		Timeout      int64    `json:"timeout"`       // 1回の取得のタイムアウト秒数
+	} `json:"http_origin"`
+	CacheRules              []CacheRule `json:"cache_rules"`               // bucketやblob名ごとにcache_expiresとcache_control_headerを変える規則 上から順に最初にマッチしたものを使う
+	MaxConcurrentTransforms int64       `json:"max_concurrent_transforms"` // 同時に行う画像加工の数の上限 タイムアウトで見捨てた加工も終わるまで数える 0ならCPU数
+}
+
+// Pin 追い出さずに残しておくblob
+// blobを指定すればそのblobだけ、prefixを指定すればblob名がそれで始まるもの
+type Pin struct {
+	Bucket string `json:"bucket"`
+	Blob   string `json:"blob,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// CacheRule bucket、blob名、Content-Typeからキャッシュの期限とCache-Controlヘッダを決める規則
+type CacheRule struct {
+	Bucket             string `json:"bucket"`               // マッチするbucket 空ならどのbucketにもマッチする
+	Pattern            string `json:"pattern"`              // マッチするblob名 path.Matchの書式 (例 "avatars/*", "static/v*/*.png") 空ならどのblobにもマッチする
+	ContentType        string `json:"content_type"`         // マッチする元画像のContent-Type "image/" のように/で終わればprefixで比べる 空ならどれにもマッチする
+	CacheExpires       int64  `json:"cache_expires"`        // 0ならcache_expiresを使う
+	CacheControlHeader string `json:"cache_control_header"` // 空ならcache_control_headerを使う
+	OriginCacheControl bool   `json:"origin_cache_control"` // trueならoriginのblobにCache-Controlがあればそれを返し、max-ageを期限にする
+}
+
+// Route Hostヘッダとパスのprefixから配信するbucketを決める規則
+type Route struct {
+	Host       string `json:"host"`        // マッチするHost 空ならどのHostにもマッチする
+	PathPrefix string `json:"path_prefix"` // マッチするパスのprefix (例 "/avatars") マッチした部分は取り除いてからURLを解釈する
+	Bucket     string `json:"bucket"`      // 配信するbucket
+	BlobPrefix string `json:"blob_prefix"` // blob名の頭につける文字列 (例 "users/avatars/")
+}
+
+// Bucket 配信対象のbucketとその取得元の設定
+type Bucket struct {
+	Name    string   `json:"name"`
+	Origin           // 取得元が1つならbucketに直接書く
+	Origins []Origin `json:"origins"` // 複数の取得元を上から順に探す。見つからなかったときだけ次を探す
+}
+
+// Origin 取得元の設定
+type Origin struct {
+	Type   string `json:"type"`   // 取得元の種類 "gcs"(省略時), "fs", "s3", "http"
+	Bucket string `json:"bucket"` // gcs, s3: 取得元のbucket名 省略時はBucketのname
+	Root   string `json:"root"`   // fs: 配信するディレクトリ
+
+	// gcs, s3
+	Endpoint string `json:"endpoint"` // 接続先 (例 "http://localhost:4443", "s3.amazonaws.com", "http://minio:9000")
+
+	// gcs
+	CredentialsFile string `json:"credentials_file"` // 省略時はGOOGLE_APPLICATION_CREDENTIALSを使う
+	Project         string `json:"project"`          // 課金先のプロジェクト (Requester Paysのbucket用)
+	Anonymous       bool   `json:"anonymous"`        // trueなら認証せずにアクセスする (公開bucket, エミュレータ用)
+
+	// s3
+	Region          string `json:"region"`        // リージョン
+	AccessKeyID     string `json:"access_key_id"` // 省略時は環境変数やIAMから取得する
+	SecretAccessKey string `json:"secret_access_key"`
+	PathStyle       bool   `json:"path_style"` // trueならpath-styleでアクセスする
+	Insecure        bool   `json:"insecure"`   // trueならhttpでアクセスする
+
+	// http
+	BaseURL string `json:"base_url"` // <base_url>/<blob_name> を取得する
 }
 
 func init() {
+	// テストは設定ファイル無しで動かす
+	if testing.Testing() {
+		return
+	}
 	err := Load()
 	if err != nil {
 		panic(err)
@@ -55,9 +163,36 @@ func Load() error {
 	if !util.DoesFileExist(config.CacheDirPath) {
 		return fmt.Errorf("object caching dir %s does not exist", config.CacheDirPath)
 	}
+	for _, pin := range config.Pins {
+		if (pin.Blob == "") == (pin.Prefix == "") {
+			return fmt.Errorf("pin for bucket %q must set exactly one of blob and prefix", pin.Bucket)
+		}
+		if !hasBucket(pin.Bucket) {
+			return fmt.Errorf("pin for unknown bucket %q", pin.Bucket)
+		}
+	}
+	for _, route := range config.Routes {
+		if !hasBucket(route.Bucket) {
+			return fmt.Errorf("route for unknown bucket %q", route.Bucket)
+		}
+	}
+	for _, rule := range config.CacheRules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid cache rule pattern %q: %v", rule.Pattern, err)
+		}
+		// bucketを省略した規則は全てのbucketに当てはまる
+		if rule.Bucket != "" && !hasBucket(rule.Bucket) {
+			return fmt.Errorf("cache rule for unknown bucket %q", rule.Bucket)
+		}
+	}
 	return nil
 }
 
+// bucketsにnameのbucketがあればtrue
+func hasBucket(name string) bool {
+	return slices.ContainsFunc(config.Buckets, func(bucket Bucket) bool { return bucket.Name == name })
+}
+
 // Get 設定構造体を返却する
 func Get() Config {
 	return config
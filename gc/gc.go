@@ -1,20 +1,35 @@
 package gc
 
 import (
+	"context"
+	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/nerikeshi-k/mono/config"
 	"github.com/nerikeshi-k/mono/env"
 	"github.com/nerikeshi-k/mono/recordstore"
-	"github.com/nerikeshi-k/mono/util"
 
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
-const randomDeleteBatchSize = 100
 const badgerGCDuration = 5 * time.Minute
+const defaultHighWatermark = 0.9
+const defaultLowWatermark = 0.8
+
+// 1回のsweepで孤立したキャッシュファイルを探す1段目のディレクトリの数
+const shardsPerSweep = 4
+
+// これより新しいキャッシュファイルは孤立していても消さない
+const orphanMinAge = 10 * time.Minute
+
+// 次に孤立したキャッシュファイルを探す1段目のディレクトリ
+var nextShard = 0
+
+// 定期的なsweepでは頻度を制限しない
+var unlimited = rate.NewLimiter(rate.Inf, 0)
 
 // Start 不要になったキャッシュとレコードの削除, badger GCの定期実行開始
 func Start() {
@@ -24,6 +39,8 @@ func Start() {
 		sugar.Debugw("start badger gc")
 	}
 	go startBadgerGC()
+	migrate()
+	go reconcile()
 	processing := false
 	ticker := time.NewTicker(time.Duration(config.Get().Collect.Span) * time.Second)
 	defer ticker.Stop()
@@ -67,52 +84,124 @@ func sweep() {
 	if env.DEBUG {
 		sugar.Debugw("sweep started")
 	}
-	sweepRecordsIfVolumeNealyFull()
-	unreachableCacheFileNames := collectUnreachableCacheFileNames()
-	if env.DEBUG {
-		sugar.Debugw("unreachable file names collected", "names", unreachableCacheFileNames)
+	if count, err := recordstore.DeleteExpired(time.Now()); err != nil {
+		sugar.Errorw("failed to delete expired records", "error", err)
+	} else if env.DEBUG {
+		sugar.Debugw("expired records deleted", "count", count)
 	}
-	for _, name := range unreachableCacheFileNames {
-		p := path.Join(config.Get().CacheDirPath, name)
-		if err := os.Remove(p); err != nil {
-			sugar.Errorw("failed to remove file", "name", name, "error", err)
+	sweepRecordsIfVolumeNealyFull()
+	for i := 0; i < shardsPerSweep; i++ {
+		_, removed, err := sweepUnreachableCacheFiles(nextShard, unlimited)
+		if err != nil {
+			sugar.Errorw("failed to sweep unreachable cache files", "shard", nextShard, "error", err)
+		} else if env.DEBUG {
+			sugar.Debugw("unreachable cache files removed", "shard", nextShard, "count", removed)
 		}
+		nextShard = (nextShard + 1) % recordstore.ShardCount
 	}
 	if env.DEBUG {
 		sugar.Debugw("sweep finised")
 	}
 }
 
-// recordから参照されていないキャッシュファイルの名前を返す
-func collectUnreachableCacheFileNames() []string {
+// 1段目のディレクトリ1つの中から、recordから参照されていないキャッシュファイルを消す
+// 全てのファイル名を一度にメモリに載せないよう、2段目のディレクトリごとに少しずつ読む
+// 確かめたファイルの数と消した数を返す
+func sweepUnreachableCacheFiles(shard int, limiter *rate.Limiter) (int, int, error) {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
-	unreachables := []string{}
-	recordedNames, err := recordstore.GetCacheFileNames(0)
-	if err != nil {
-		sugar.Errorw("failed to get keys on collectUnreachables", "error", err)
-		return []string{}
-	}
-	cacheFileNames, err := util.ListDir(config.Get().CacheDirPath)
+	shardPath := recordstore.GetShardPath(shard)
+	subShards, err := os.ReadDir(shardPath)
 	if err != nil {
-		sugar.Errorw("failed to get cache file names on collectUnreachables", "error", err)
-		return []string{}
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
 	}
-	for _, name := range cacheFileNames {
-		if !recordedNames.Contains(name) {
-			unreachables = append(unreachables, name)
+	checked := 0
+	removed := 0
+	for _, subShard := range subShards {
+		if !subShard.IsDir() {
+			continue
+		}
+		dir, err := os.Open(filepath.Join(shardPath, subShard.Name()))
+		if err != nil {
+			return checked, removed, err
 		}
+		for {
+			entries, err := dir.ReadDir(1000)
+			for _, entry := range entries {
+				if !entry.Type().IsRegular() {
+					continue
+				}
+				if err := limiter.Wait(context.Background()); err != nil {
+					dir.Close()
+					return checked, removed, err
+				}
+				checked++
+				// 書き込んでからRecordを保存するまでの間のファイルを消さないよう、新しいものは見逃す
+				info, err := entry.Info()
+				if err != nil || time.Since(info.ModTime()) < orphanMinAge {
+					continue
+				}
+				referenced, err := recordstore.IsCacheFileReferenced(entry.Name())
+				if err != nil {
+					dir.Close()
+					return checked, removed, err
+				}
+				if referenced {
+					continue
+				}
+				if err := os.Remove(filepath.Join(dir.Name(), entry.Name())); err != nil {
+					sugar.Errorw("failed to remove file", "name", entry.Name(), "error", err)
+					continue
+				}
+				removed++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				dir.Close()
+				return checked, removed, err
+			}
+		}
+		dir.Close()
 	}
-	return unreachables
+	return checked, removed, nil
 }
 
-// キャッシュ用ディレクトリの容量が限界に近くなってきた場合キーをいくつか消す
+// キャッシュ用ディレクトリの容量が限界に近くなってきた場合、
+// 最後にリクエストされたのが古いものからlow watermarkを下回るまでレコードを消す
 func sweepRecordsIfVolumeNealyFull() error {
-	volume := util.GetDirSizeMB(config.Get().CacheDirPath)
-	// if volume is over 90% of max
-	if volume > (float64(config.Get().MaxCacheVolume) * 0.9) {
-		recordstore.DeleteKeysWithSize(randomDeleteBatchSize)
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	high := config.Get().Collect.HighWatermark
+	if high <= 0 {
+		high = defaultHighWatermark
+	}
+	low := config.Get().Collect.LowWatermark
+	if low <= 0 {
+		low = defaultLowWatermark
+	}
+	maxVolume := float64(config.Get().MaxCacheVolume)
+	usage, err := recordstore.GetUsage()
+	if err != nil {
+		sugar.Errorw("failed to get cache usage", "error", err)
+		return err
+	}
+	volume := float64(usage.Total) / 1024 / 1024
+	if volume <= maxVolume*high {
+		return nil
+	}
+	size := int64((volume - maxVolume*low) * 1024 * 1024)
+	count, freed, err := recordstore.EvictLeastRecentlyUsed(size)
+	if err != nil {
+		sugar.Errorw("failed to evict records", "error", err)
+		return err
 	}
+	sugar.Infow("evicted least recently used records", "volumeMB", volume, "count", count, "freedMB", float64(freed)/1024/1024)
 	return nil
 }
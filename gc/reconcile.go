@@ -0,0 +1,92 @@
+package gc
+
+import (
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/recordstore"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const defaultReconcileRateLimit = 1000
+
+// 古いバージョンで保存したRecordを今の形式に直す
+// sweepが参照されているファイルを孤立したものと見なさないよう、sweepを始める前に終わらせる
+func migrate() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	count, err := recordstore.Migrate()
+	if err != nil {
+		sugar.Errorw("failed to migrate records", "error", err)
+		return
+	}
+	if count > 0 {
+		sugar.Infow("migrated records", "count", count)
+	}
+}
+
+// 起動時にrecordstoreとキャッシュ用ディレクトリを突き合わせる
+// キャッシュファイルの無いRecordと、どのRecordからも参照されていないファイルを消し、使用量の集計を直す
+// 配信の邪魔をしないよう、バックグラウンドでファイルを確かめる頻度を制限して行う
+func reconcile() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	start := time.Now()
+	r := config.Get().Collect.ReconcileRateLimit
+	if r <= 0 {
+		r = defaultReconcileRateLimit
+	}
+	limiter := rate.NewLimiter(rate.Limit(r), 1)
+
+	before, err := recordstore.GetUsage()
+	if err != nil {
+		sugar.Errorw("failed to get cache usage", "error", err)
+		return
+	}
+	// 設定ファイルで固定したものが変わっていれば反映する
+	pinned, err := recordstore.ApplyPins()
+	if err != nil {
+		sugar.Errorw("failed to apply pins", "error", err)
+		return
+	}
+	if _, err := recordstore.RebuildUsage(); err != nil {
+		sugar.Errorw("failed to rebuild cache usage", "error", err)
+		return
+	}
+	checkedRecords, droppedRecords, err := recordstore.DropDanglingRecords(limiter)
+	if err != nil {
+		sugar.Errorw("failed to drop dangling records", "error", err)
+		return
+	}
+	checkedFiles := 0
+	removedFiles := 0
+	for shard := 0; shard < recordstore.ShardCount; shard++ {
+		checked, removed, err := sweepUnreachableCacheFiles(shard, limiter)
+		checkedFiles += checked
+		removedFiles += removed
+		if err != nil {
+			sugar.Errorw("failed to sweep unreachable cache files", "shard", shard, "error", err)
+		}
+	}
+	after, err := recordstore.GetUsage()
+	if err != nil {
+		sugar.Errorw("failed to get cache usage", "error", err)
+		return
+	}
+	sugar.Infow("reconciled records and cache files",
+		"checkedRecords", checkedRecords,
+		"droppedRecords", droppedRecords,
+		"checkedFiles", checkedFiles,
+		"removedFiles", removedFiles,
+		"pinChangedRecords", pinned,
+		"usageBeforeMB", float64(before.Total)/1024/1024,
+		"usageAfterMB", float64(after.Total)/1024/1024,
+		"buckets", after.Buckets,
+		"pinnedMB", float64(after.Pinned)/1024/1024,
+		"elapsed", time.Since(start).String(),
+	)
+}
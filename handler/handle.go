@@ -1,9 +1,9 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
 
@@ -31,8 +31,16 @@ func Handle(c echo.Context) error {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
+	// ルーティング X-Bucket-Nameヘッダでbucketが指定されていればルーティングは使わず、パスをそのまま解釈する
+	bucketName := c.Request().Header.Get("X-Bucket-Name")
+	var route *config.Route
+	pathname := c.Request().URL.Path
+	if bucketName == "" {
+		route, pathname = matchRoute(c.Request().Host, pathname)
+	}
+
 	// URLパース
-	query, err := parseURL(c.Request().URL)
+	query, err := parsePath(pathname)
 	if err != nil {
 		if err == ErrInvalidRequest {
 			return c.String(http.StatusBadRequest, "invalid parameter")
@@ -41,8 +49,11 @@ func Handle(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "server error")
 	}
 
-	// bucket名取得
-	bucketName := c.Request().Header.Get("X-Bucket-Name")
+	blobName := query.BlobName
+	if route != nil {
+		bucketName = route.Bucket
+		blobName = route.BlobPrefix + blobName
+	}
 	if bucketName == "" {
 		// 指定がないならconfigにある一個目のbuckets名とする
 		buckets := config.Get().Buckets
@@ -51,25 +62,42 @@ func Handle(c echo.Context) error {
 		}
 	}
 
-	product, err := provider.Provide(bucketName, query.BlobName, query.PreprocessQuery)
+	product, err := provider.Provide(c.Request().Context(), bucketName, blobName, query.PreprocessQuery)
 	if err != nil {
 		if err == provider.ErrNotFound {
 			return c.String(http.StatusNotFound, "400 not found")
 		}
+		if err == provider.ErrGatewayTimeout {
+			return c.String(http.StatusGatewayTimeout, "504 gateway timeout")
+		}
+		if err == provider.ErrServiceUnavailable {
+			return c.String(http.StatusServiceUnavailable, "503 service unavailable")
+		}
+		if errors.Is(err, context.Canceled) {
+			// クライアントが切断済みなので何も返さない
+			return nil
+		}
 		if err == provider.ErrInternalServerError {
 			return c.String(http.StatusInternalServerError, "500 server error")
 		}
 		return c.String(http.StatusInternalServerError, "500 server error")
 	}
-	c.Response().Header().Set("Cache-Control", config.Get().CacheControlHeader)
+	c.Response().Header().Set("Cache-Control", product.CacheControl)
+	if product.Stale {
+		c.Response().Header().Set("Warning", `110 - "Response is Stale"`)
+		c.Response().Header().Set("X-Mono-Cache", "stale")
+	}
 	return c.Blob(http.StatusOK, query.PreprocessQuery.EncodeTarget, product.Data)
 }
 
-func parseURL(URL *url.URL) (*Query, error) {
+func parsePath(pathname string) (*Query, error) {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
-	pathname := URL.Path[1:] // without first "/"
+	if pathname == "" {
+		return nil, ErrInvalidRequest
+	}
+	pathname = pathname[1:] // without first "/"
 	i := strings.Index(pathname, "/")
 	if i == -1 {
 		return nil, ErrInvalidRequest
@@ -85,14 +113,7 @@ func parseURL(URL *url.URL) (*Query, error) {
 	if result := r.FindAllSubmatch([]byte(blobName), -1); len(result) > 0 {
 		extension := string(result[0][1])
 		blobName = blobName[:len(blobName)-len(extension)-1]
-		switch extension {
-		case "png":
-			encodingTarget = "image/png"
-		case "jpeg", "jpg":
-			encodingTarget = "image/jpeg"
-		case "webp":
-			encodingTarget = "image/webp"
-		}
+		encodingTarget = extensionToContentType(extension)
 	}
 
 	preprocessQuery.EncodeTarget = encodingTarget
@@ -103,6 +124,18 @@ func parseURL(URL *url.URL) (*Query, error) {
 	return query, nil
 }
 
+func extensionToContentType(extension string) string {
+	switch extension {
+	case "png":
+		return "image/png"
+	case "jpeg", "jpg":
+		return "image/jpeg"
+	case "webp":
+		return "image/webp"
+	}
+	return ""
+}
+
 func parseRawQuery(raw string) *preprocess.Query {
 	query := preprocess.Query{}
 	fragments := strings.Split(raw, ",")
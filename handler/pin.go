@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/prefetch"
+	"github.com/nerikeshi-k/mono/recordstore"
+
+	echo "github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// GetPins 固定したblobの一覧を返す
+func GetPins(c echo.Context) error {
+	return c.JSON(http.StatusOK, recordstore.GetPins())
+}
+
+func bindPin(c echo.Context) (*config.Pin, error) {
+	var pin config.Pin
+	if err := c.Bind(&pin); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	if pin.Bucket == "" || (pin.Blob == "") == (pin.Prefix == "") {
+		return nil, ErrInvalidRequest
+	}
+	return &pin, nil
+}
+
+// AddPin blobかprefixを固定し、先読みを始める
+func AddPin(c echo.Context) error {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	pin, err := bindPin(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid parameter")
+	}
+	if !bucketExists(pin.Bucket) {
+		return c.String(http.StatusNotFound, "bucket not found")
+	}
+	if err := recordstore.AddPin(*pin); err != nil {
+		sugar.Errorw("failed to add pin", "pin", pin, "error", err)
+		return c.String(http.StatusInternalServerError, "server error")
+	}
+	jobID := prefetch.StartPins([]config.Pin{*pin})
+	sugar.Infow("pinned", "pin", pin, "job", jobID)
+	return c.JSON(http.StatusAccepted, map[string]string{"job": jobID})
+}
+
+// RemovePin 固定を外す
+func RemovePin(c echo.Context) error {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	pin, err := bindPin(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid parameter")
+	}
+	err = recordstore.RemovePin(*pin)
+	if err == recordstore.ErrPinNotFound {
+		return c.String(http.StatusNotFound, "pin not found")
+	}
+	if err == recordstore.ErrPinInConfig {
+		return c.String(http.StatusConflict, "pin is defined in config")
+	}
+	if err != nil {
+		sugar.Errorw("failed to remove pin", "pin", pin, "error", err)
+		return c.String(http.StatusInternalServerError, "server error")
+	}
+	sugar.Infow("unpinned", "pin", pin)
+	return c.NoContent(http.StatusAccepted)
+}
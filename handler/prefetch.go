@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/nerikeshi-k/mono/prefetch"
+	"github.com/nerikeshi-k/mono/preprocess"
+
+	echo "github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// 1回のリクエストで受け付けるblobの数
+const maxPrefetchEntries = 100000
+
+// PrefetchRequest 先読みするblobの一覧
+type PrefetchRequest struct {
+	Entries []PrefetchEntry `json:"entries"`
+}
+
+// PrefetchEntry 先読みするblob
+// variantsはURLの1段目と同じ書き方で、末尾に拡張子をつけると変換先になる (例: "w=400", "w=200,h=200.webp")
+// 空ならクエリ無しのリクエストと同じものを作る
+type PrefetchEntry struct {
+	Bucket   string   `json:"bucket"`
+	Blob     string   `json:"blob"`
+	Variants []string `json:"variants"`
+}
+
+var variantExtension = regexp.MustCompile(`\.(png|jpeg|jpg|webp)$`)
+
+func parseVariant(spec string) preprocess.Query {
+	encodeTarget := ""
+	if result := variantExtension.FindStringSubmatch(spec); result != nil {
+		spec = spec[:len(spec)-len(result[0])]
+		encodeTarget = extensionToContentType(result[1])
+	}
+	query := parseRawQuery(spec)
+	query.EncodeTarget = encodeTarget
+	return *query
+}
+
+// StartPrefetch 先読みのジョブを始め、ジョブIDを返す
+func StartPrefetch(c echo.Context) error {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	var req PrefetchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "invalid parameter")
+	}
+	if len(req.Entries) == 0 || len(req.Entries) > maxPrefetchEntries {
+		return c.String(http.StatusBadRequest, "invalid parameter")
+	}
+	entries := make([]prefetch.Entry, 0, len(req.Entries))
+	for _, e := range req.Entries {
+		if e.Blob == "" {
+			return c.String(http.StatusBadRequest, "invalid parameter")
+		}
+		if !bucketExists(e.Bucket) {
+			return c.String(http.StatusNotFound, "bucket not found")
+		}
+		entry := prefetch.Entry{Bucket: e.Bucket, Blob: e.Blob}
+		if len(e.Variants) == 0 {
+			entry.Queries = append(entry.Queries, preprocess.Query{})
+		}
+		for _, spec := range e.Variants {
+			entry.Queries = append(entry.Queries, parseVariant(spec))
+		}
+		entries = append(entries, entry)
+	}
+	id := prefetch.Start(entries)
+	sugar.Infow("prefetch job started", "id", id, "entries", len(entries))
+	return c.JSON(http.StatusAccepted, map[string]string{"id": id})
+}
+
+// GetPrefetch 先読みのジョブの進み具合を返す
+func GetPrefetch(c echo.Context) error {
+	job, err := prefetch.Get(c.Param("id"))
+	if err == prefetch.ErrJobNotFound {
+		return c.String(http.StatusNotFound, "job not found")
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// CancelPrefetch 先読みのジョブを止める
+func CancelPrefetch(c echo.Context) error {
+	if err := prefetch.Cancel(c.Param("id")); err == prefetch.ErrJobNotFound {
+		return c.String(http.StatusNotFound, "job not found")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/provider"
+	"github.com/nerikeshi-k/mono/recordstore"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+)
+
+// PurgeRequest purgeの対象
+// blobを指定すればそのblobだけ、prefixを指定すればblob名がそれで始まるもの、どちらも無ければbucketの全てを消す
+type PurgeRequest struct {
+	Bucket string `json:"bucket"`
+	Blob   string `json:"blob"`
+	Prefix string `json:"prefix"`
+}
+
+// AdminAuth admin.tokenのBearerトークンを確かめるmiddleware
+func AdminAuth() echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		token := config.Get().Admin.Token
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	})
+}
+
+func bucketExists(bucketName string) bool {
+	for _, bucket := range config.Get().Buckets {
+		if bucket.Name == bucketName {
+			return true
+		}
+	}
+	return false
+}
+
+// Purge 指定されたキャッシュを消し、消したものの数を返す
+func Purge(c echo.Context) error {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	var req PurgeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "invalid parameter")
+	}
+	if req.Bucket == "" || (req.Blob != "" && req.Prefix != "") {
+		return c.String(http.StatusBadRequest, "invalid parameter")
+	}
+	if !bucketExists(req.Bucket) {
+		return c.String(http.StatusNotFound, "bucket not found")
+	}
+
+	var result *recordstore.PurgeResult
+	var err error
+	if req.Blob != "" {
+		result, err = provider.PurgeBlob(req.Bucket, req.Blob)
+	} else {
+		result, err = provider.PurgePrefix(req.Bucket, req.Prefix)
+	}
+	if err != nil {
+		sugar.Errorw("failed to purge", "bucket", req.Bucket, "blob", req.Blob, "prefix", req.Prefix, "error", err)
+		return c.String(http.StatusInternalServerError, "server error")
+	}
+	sugar.Infow("purged", "bucket", req.Bucket, "blob", req.Blob, "prefix", req.Prefix, "result", result)
+	return c.JSON(http.StatusOK, result)
+}
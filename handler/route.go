@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net"
+	"strings"
+
+	"github.com/nerikeshi-k/mono/config"
+)
+
+// matchRoute configのroutesから最初にマッチした規則と、path_prefixを取り除いたパスを返す
+// マッチしなければnilとそのままのパスを返す
+func matchRoute(host string, pathname string) (*config.Route, string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	routes := config.Get().Routes
+	for i := range routes {
+		route := &routes[i]
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(route.PathPrefix, "/")
+		if prefix == "" {
+			return route, pathname
+		}
+		// "/avatars" は "/avatars/..." にマッチし "/avatarsx/..." にはマッチしない
+		if strings.HasPrefix(pathname, prefix+"/") {
+			return route, pathname[len(prefix):]
+		}
+	}
+	return nil, pathname
+}
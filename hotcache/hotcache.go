@@ -0,0 +1,101 @@
+package hotcache
+
+import (
+	"expvar"
+	"sync/atomic"
+
+	"github.com/nerikeshi-k/mono/config"
+
+	"github.com/dgraph-io/ristretto"
+	"go.uber.org/zap"
+)
+
+// キャッシュファイル1つあたりの大きさの見積もり NumCountersを決めるのに使う
+const estimatedItemSize = 16 * 1024
+
+// cache キャッシュファイル名 -> 中身
+// キャッシュファイル名は取得・加工のたびに新しく振られ、中身は書き換わらないので無効化はしない
+// 参照されなくなったものはそのうち追い出される
+var cache *ristretto.Cache
+
+// ristrettoのMetricsはHasでの問い合わせも数えてしまうので、Getでの読み出しだけを数える
+var hits, misses atomic.Int64
+
+func init() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	maxCost := config.Get().HotCache.MaxVolume * 1024 * 1024
+	if maxCost <= 0 {
+		return
+	}
+	numCounters := maxCost / estimatedItemSize * 10
+	if numCounters < 100000 {
+		numCounters = 100000
+	}
+	var err error
+	cache, err = ristretto.NewCache(&ristretto.Config{
+		NumCounters:        numCounters,
+		MaxCost:            maxCost,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+	})
+	if err != nil {
+		sugar.Fatalw("Failed to create hot cache", "error", err)
+	}
+	expvar.Publish("hot_cache", expvar.Func(func() interface{} {
+		h, m := hits.Load(), misses.Load()
+		ratio := 0.0
+		if h+m > 0 {
+			ratio = float64(h) / float64(h+m)
+		}
+		return map[string]interface{}{
+			"hits":   h,
+			"misses": m,
+			"ratio":  ratio,
+			"size":   cache.Metrics.CostAdded() - cache.Metrics.CostEvicted(),
+			"items":  cache.Metrics.KeysAdded() - cache.Metrics.KeysEvicted(),
+		}
+	}))
+}
+
+// Get キャッシュファイル名からメモリ上の中身を探す
+func Get(cacheFileName string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	value, ok := cache.Get(cacheFileName)
+	if !ok {
+		misses.Add(1)
+		return nil, false
+	}
+	hits.Add(1)
+	return value.([]byte), true
+}
+
+// Has キャッシュファイルの中身がメモリに載っていればtrue
+func Has(cacheFileName string) bool {
+	if cache == nil {
+		return false
+	}
+	_, ok := cache.Get(cacheFileName)
+	return ok
+}
+
+// Set キャッシュファイルの中身をメモリに載せる
+// 載せるかどうかは参照される頻度をもとにristrettoが決める
+func Set(cacheFileName string, data []byte) {
+	if cache == nil {
+		return
+	}
+	cache.Set(cacheFileName, data, int64(len(data)))
+}
+
+// Delete キャッシュファイルの中身をメモリから消す
+func Delete(cacheFileName string) {
+	if cache == nil {
+		return
+	}
+	cache.Del(cacheFileName)
+}
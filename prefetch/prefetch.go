@@ -0,0 +1,239 @@
+package prefetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/preprocess"
+	"github.com/nerikeshi-k/mono/provider"
+	"github.com/nerikeshi-k/mono/storageclient"
+	"github.com/nerikeshi-k/mono/util"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+const defaultConcurrency = 4
+
+// 覚えておく終わったジョブの数
+const maxFinishedJobs = 100
+
+// ジョブごとに覚えておくエラーの数
+const maxJobErrors = 20
+
+// prefixで固定したときにoriginから一覧を取るタイムアウト
+const pinListTimeout = time.Minute
+
+// ジョブの状態
+const (
+	StateRunning  = "running"
+	StateDone     = "done"
+	StateCanceled = "canceled"
+)
+
+var (
+	// ErrJobNotFound ジョブIDに対応するジョブがない
+	ErrJobNotFound = errors.New("job not found")
+)
+
+// Entry 先読みするblobと、作っておく加工済みの画像
+type Entry struct {
+	Bucket  string
+	Blob    string
+	Queries []preprocess.Query
+}
+
+// Job 先読みのジョブの進み具合
+type Job struct {
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	Total      int       `json:"total"`     // 取得・加工する数
+	Succeeded  int       `json:"succeeded"` // 終わった数
+	Failed     int       `json:"failed"`    // 失敗した数
+	Errors     []string  `json:"errors"`    // 失敗したものの一部
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	cancel context.CancelFunc
+}
+
+var (
+	mu       sync.Mutex
+	jobs     = map[string]*Job{}
+	finished = []string{}
+	// 全てのジョブで共有する同時実行数と頻度の制限
+	sem     *semaphore.Weighted
+	limiter *rate.Limiter
+)
+
+func init() {
+	concurrency := config.Get().Prefetch.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	sem = semaphore.NewWeighted(concurrency)
+	limiter = rate.NewLimiter(rate.Inf, 1)
+	if r := config.Get().Prefetch.RateLimit; r > 0 {
+		limiter = rate.NewLimiter(rate.Limit(r), 1)
+	}
+}
+
+// Start 先読みのジョブを始め、ジョブIDを返す
+func Start(entries []Entry) string {
+	ctx, job := newJob()
+	addEntries(job, entries)
+	go run(ctx, job, entries)
+	return job.ID
+}
+
+// 実行中のジョブを登録する
+func newJob() (context.Context, *Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        util.GenerateUUID(),
+		State:     StateRunning,
+		Errors:    []string{},
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	}
+	mu.Lock()
+	jobs[job.ID] = job
+	mu.Unlock()
+	return ctx, job
+}
+
+// 取得・加工する数をジョブに足す
+func addEntries(job *Job, entries []Entry) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, entry := range entries {
+		job.Total += len(entry.Queries)
+	}
+}
+
+// Get ジョブの進み具合を返す
+func Get(id string) (Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	snapshot := *job
+	snapshot.Errors = append([]string{}, job.Errors...)
+	return snapshot, nil
+}
+
+// Cancel 実行中のジョブを止める
+func Cancel(id string) error {
+	mu.Lock()
+	job, ok := jobs[id]
+	mu.Unlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+	job.cancel()
+	return nil
+}
+
+func run(ctx context.Context, job *Job, entries []Entry) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		for _, query := range entry.Queries {
+			if err := sem.Acquire(ctx, 1); err != nil {
+				break
+			}
+			if err := limiter.Wait(ctx); err != nil {
+				sem.Release(1)
+				break
+			}
+			wg.Add(1)
+			go func(entry Entry, query preprocess.Query) {
+				defer wg.Done()
+				defer sem.Release(1)
+				_, err := provider.Provide(ctx, entry.Bucket, entry.Blob, query)
+				report(job, entry, query, err)
+			}(entry, query)
+		}
+	}
+	wg.Wait()
+	job.cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	job.State = StateDone
+	if ctx.Err() != nil && job.Succeeded+job.Failed < job.Total {
+		job.State = StateCanceled
+	}
+	job.FinishedAt = time.Now()
+	sugar.Infow("prefetch job finished", "id", job.ID, "state", job.State, "total", job.Total, "succeeded", job.Succeeded, "failed", job.Failed)
+
+	// 終わったジョブは古いものから忘れる
+	finished = append(finished, job.ID)
+	if len(finished) > maxFinishedJobs {
+		delete(jobs, finished[0])
+		finished = finished[1:]
+	}
+}
+
+func report(job *Job, entry Entry, query preprocess.Query, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil {
+		job.Succeeded++
+		return
+	}
+	job.Failed++
+	if len(job.Errors) < maxJobErrors {
+		job.Errors = append(job.Errors, fmt.Sprintf("%s/%s (%s): %v", entry.Bucket, entry.Blob, query.Normalize(), err))
+	}
+}
+
+// StartPins 固定したblobを先読みするジョブを始め、すぐにジョブIDを返す。固定したものが無ければ空文字列を返す
+// prefixで固定したものはジョブの中でoriginから一覧を取って先読みする
+// 一覧を取れなかったprefixは飛ばし、取得されたときに固定されるのに任せる
+func StartPins(pins []config.Pin) string {
+	if len(pins) == 0 {
+		return ""
+	}
+	ctx, job := newJob()
+	go func() {
+		entries := listPins(ctx, pins)
+		addEntries(job, entries)
+		run(ctx, job, entries)
+	}()
+	return job.ID
+}
+
+// 固定したものを先読みするentryにする
+func listPins(ctx context.Context, pins []config.Pin) []Entry {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	entries := []Entry{}
+	for _, pin := range pins {
+		if pin.Blob != "" {
+			entries = append(entries, Entry{Bucket: pin.Bucket, Blob: pin.Blob, Queries: []preprocess.Query{{}}})
+			continue
+		}
+		listCtx, cancel := context.WithTimeout(ctx, pinListTimeout)
+		names, err := storageclient.ListBlobs(listCtx, pin.Bucket, pin.Prefix)
+		cancel()
+		if err != nil {
+			sugar.Warnw("failed to list pinned blobs", "pin", pin, "error", err)
+			continue
+		}
+		for _, name := range names {
+			entries = append(entries, Entry{Bucket: pin.Bucket, Blob: name, Queries: []preprocess.Query{{}}})
+		}
+	}
+	return entries
+}
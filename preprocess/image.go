@@ -2,6 +2,7 @@ package preprocess
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -23,16 +24,43 @@ func castToNRGBA(img image.Image) *image.NRGBA {
 	return imaging.Clone(img)
 }
 
-func decode(data []byte, contentType string) (image.Image, error) {
+// ctxReader ctxがキャンセルされたらReadがctxのエラーを返す。デコードを途中で止めるのに使う
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxWriter ctxがキャンセルされたらWriteがctxのエラーを返す。エンコードを途中で止めるのに使う
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// webpはcgoで一度にデコードするので、途中では止まらない
+func decode(ctx context.Context, data []byte, contentType string) (image.Image, error) {
 	switch contentType {
 	case "image/jpeg":
-		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		decoded, err := jpeg.Decode(&ctxReader{ctx: ctx, r: bytes.NewReader(data)})
 		if err != nil {
 			return nil, err
 		}
 		return castToNRGBA(decoded), nil
 	case "image/png":
-		decoded, err := png.Decode(bytes.NewReader((data)))
+		decoded, err := png.Decode(&ctxReader{ctx: ctx, r: bytes.NewReader(data)})
 		if err != nil {
 			return nil, err
 		}
@@ -52,16 +80,17 @@ func decode(data []byte, contentType string) (image.Image, error) {
 	}
 }
 
-func encode(img image.Image, encodeTarget string) ([]byte, error) {
+func encode(ctx context.Context, img image.Image, encodeTarget string) ([]byte, error) {
 	buf := new(bytes.Buffer)
+	w := &ctxWriter{ctx: ctx, w: buf}
 	switch encodeTarget {
 	case "image/jpeg":
-		err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+		err := jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
 		if err != nil {
 			return nil, err
 		}
 	case "image/png":
-		err := png.Encode(buf, img)
+		err := png.Encode(w, img)
 		if err != nil {
 			return nil, err
 		}
@@ -70,7 +99,7 @@ func encode(img image.Image, encodeTarget string) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = webp.EncodeRGBA(buf, img, config)
+		err = webp.EncodeRGBA(w, img, config)
 		if err != nil {
 			return nil, err
 		}
@@ -81,11 +110,18 @@ func encode(img image.Image, encodeTarget string) ([]byte, error) {
 }
 
 // ReduceImage クエリに従って画像を加工して返す
-func ReduceImage(data []byte, sourceImageContentType string, q Query) ([]byte, error) {
-	img, err := decode(data, sourceImageContentType)
+// 各工程の間とjpeg, pngのデコード・エンコードの途中でctxを確認し、キャンセルされていればctxのエラーを返す
+func ReduceImage(ctx context.Context, data []byte, sourceImageContentType string, q Query) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	img, err := decode(ctx, data, sourceImageContentType)
 	if err != nil {
 		return nil, err
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// リサイズ maxwidth, maxheightが指定されていた場合はwidth, heightより優先する
 	size := img.Bounds().Size()
@@ -102,10 +138,14 @@ func ReduceImage(data []byte, sourceImageContentType string, q Query) ([]byte, e
 		img = imaging.Resize(img, q.Width, q.Height, imaging.Lanczos)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// 書き出し
 	encodeTarget := q.EncodeTarget
 	if encodeTarget == "" {
 		encodeTarget = sourceImageContentType
 	}
-	return encode(img, encodeTarget)
+	return encode(ctx, img, encodeTarget)
 }
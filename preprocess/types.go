@@ -1,5 +1,7 @@
 package preprocess
 
+import "fmt"
+
 // Query preprocess指示
 type Query struct {
 	MaxWidth     int    // 最大width
@@ -8,3 +10,13 @@ type Query struct {
 	Height       int    // height
 	EncodeTarget string // 出力時の形式 ("", "image/jpeg", "image/png", "image/webp")
 }
+
+// Normalize 加工結果が同じになるQueryが同じ文字列になるように正規化した文字列を返す
+func (q Query) Normalize() string {
+	// ReduceImageではmaxwidth, maxheightが優先され、大きすぎるwidth, heightは無視される
+	if q.MaxWidth != 0 || q.MaxHeight != 0 || q.Width > MAX_WIDTH || q.Height > MAX_HEIGHT {
+		q.Width = 0
+		q.Height = 0
+	}
+	return fmt.Sprintf("w=%d,h=%d,wf=%d,hf=%d,e=%s", q.MaxWidth, q.MaxHeight, q.Width, q.Height, q.EncodeTarget)
+}
@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"os"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/hotcache"
+	"github.com/nerikeshi-k/mono/recordstore"
+	"github.com/nerikeshi-k/mono/util"
+	"go.uber.org/zap"
+)
+
+// errCorruptCache キャッシュファイルの中身がRecordと合わなかった。Recordは消してあるので取得し直せばよい
+var errCorruptCache = errors.New("corrupt cache file")
+
+// キャッシュファイルを書き込むための一時ファイルを作る
+// 書き込み途中のファイルを読んだり、途中で落ちて壊れたファイルが残ったりしないよう、書き終えてからcommitCacheFileでrenameする
+func createCacheFile(cacheFileName string) (*os.File, error) {
+	if err := recordstore.MakeCacheDir(cacheFileName); err != nil {
+		return nil, err
+	}
+	return os.Create(recordstore.GetTempPath(cacheFileName))
+}
+
+// 一時ファイルをディスクに書き出してから本来のパスにrenameする。失敗したら一時ファイルは消す
+func commitCacheFile(fp *os.File, cacheFileName string) error {
+	err := fp.Sync()
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), recordstore.GetCachePath(cacheFileName))
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return nil
+}
+
+// 書き込みをやめて一時ファイルを消す
+func discardCacheFile(fp *os.File) {
+	fp.Close()
+	os.Remove(fp.Name())
+}
+
+// dataをキャッシュファイルとして書き込む
+func writeCacheFile(cacheFileName string, data []byte) error {
+	fp, err := createCacheFile(cacheFileName)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		discardCacheFile(fp)
+		return err
+	}
+	return commitCacheFile(fp, cacheFileName)
+}
+
+// キャッシュファイルを読む。メモリに載っていればディスクには触らない
+// 中身がRecordと合わなければRecordとファイルを消してerrCorruptCacheを返す
+func readCacheFile(key string, record *recordstore.Record) ([]byte, error) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	if data, ok := hotcache.Get(record.CacheFileName); ok {
+		return data, nil
+	}
+	data, err := os.ReadFile(record.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	if !verifyCacheFile(record, data) {
+		stats.Add("corrupt_evictions", 1)
+		sugar.Warnw("evicted corrupt cache file", "key", key, "name", record.CacheFileName)
+		recordstore.DeleteRecord(key)
+		os.Remove(record.GetPath())
+		return nil, errCorruptCache
+	}
+	hotcache.Set(record.CacheFileName, data)
+	return data, nil
+}
+
+// サイズとchecksumを確かめる。checksumはintegrity.sample_rateの割合だけ確かめる
+func verifyCacheFile(record *recordstore.Record, data []byte) bool {
+	if int64(len(data)) != record.Size {
+		return false
+	}
+	// checksumを保存していなかった頃のRecord
+	if record.Checksum == 0 {
+		return true
+	}
+	rate := config.Get().Integrity.SampleRate
+	if rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return true
+	}
+	return crc32.Checksum(data, util.ChecksumTable) == record.Checksum
+}
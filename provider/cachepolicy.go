@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/recordstore"
+)
+
+// blobにマッチするcache_rulesの規則を返す。無ければnil
+func matchCacheRule(bucketName string, blobName string, contentType string) *config.CacheRule {
+	rules := config.Get().CacheRules
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Bucket != "" && rule.Bucket != bucketName {
+			continue
+		}
+		if rule.Pattern != "" {
+			// パターンはconfigの読み込み時に確かめてある
+			if matched, _ := path.Match(rule.Pattern, blobName); !matched {
+				continue
+			}
+		}
+		if rule.ContentType != "" {
+			if strings.HasSuffix(rule.ContentType, "/") {
+				if !strings.HasPrefix(contentType, rule.ContentType) {
+					continue
+				}
+			} else if contentType != rule.ContentType {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// Cache-Controlヘッダから共有キャッシュとして持っておいてよい秒数を読む。書かれていなければfalse
+func parseMaxAge(cacheControl string) (time.Duration, bool) {
+	maxAge := time.Duration(-1)
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "s-maxage":
+			// 共有キャッシュ向けの指定はmax-ageより優先する
+			if seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second, true
+			}
+		case "max-age":
+			if seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil && seconds >= 0 {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+	return maxAge, true
+}
+
+// 元画像のrecordの期限までの長さと、返すCache-Controlヘッダを決める
+func cachePolicy(bucketName string, blobName string, record *recordstore.Record) (time.Duration, string) {
+	expires := time.Duration(config.Get().CacheExpires) * time.Second
+	header := config.Get().CacheControlHeader
+	rule := matchCacheRule(bucketName, blobName, record.ContentType)
+	if rule == nil {
+		return expires, header
+	}
+	if rule.CacheExpires > 0 {
+		expires = time.Duration(rule.CacheExpires) * time.Second
+	}
+	if rule.CacheControlHeader != "" {
+		header = rule.CacheControlHeader
+	}
+	if rule.OriginCacheControl && record.CacheControl != "" {
+		header = record.CacheControl
+		if maxAge, ok := parseMaxAge(record.CacheControl); ok {
+			expires = maxAge
+		}
+	}
+	return expires, header
+}
@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"context"
+	"sync"
+)
+
+// sharedGroup 同じキーへの同時の処理を1回にまとめる
+// 処理には待っているリクエストとは別のctxを渡し、待っているリクエストが全て切断されたらキャンセルする
+type sharedGroup struct {
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+type sharedCall struct {
+	cancel  context.CancelFunc
+	waiters int
+	done    chan struct{}
+	val     interface{}
+	err     error
+}
+
+// keyの処理が無ければfnを始め、待つ側として登録する。既にあれば相乗りしてsharedがtrueになる
+func (g *sharedGroup) join(key string, fn func(ctx context.Context) (interface{}, error)) (call *sharedCall, shared bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		call.waiters++
+		return call, true
+	}
+	if g.calls == nil {
+		g.calls = map[string]*sharedCall{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	call = &sharedCall{cancel: cancel, waiters: 1, done: make(chan struct{})}
+	g.calls[key] = call
+	go func() {
+		call.val, call.err = fn(ctx)
+		g.mu.Lock()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		cancel()
+		close(call.done)
+	}()
+	return call, false
+}
+
+// 待つのをやめる。誰も待たなくなったら処理をキャンセルする
+func (g *sharedGroup) leave(key string, call *sharedCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	// 後から来たリクエストがキャンセルした処理に相乗りしないよう外しておく
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// Do keyの処理が無ければfnを始め、終わるかctxがキャンセルされるまで待つ
+// 他のリクエストが始めた処理に相乗りしたらsharedがtrueになる
+func (g *sharedGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (val interface{}, shared bool, err error) {
+	call, shared := g.join(key, fn)
+	select {
+	case <-ctx.Done():
+		g.leave(key, call)
+		return nil, shared, ctx.Err()
+	case <-call.done:
+		g.leave(key, call)
+		return call.val, shared, call.err
+	}
+}
+
+// Go keyの処理が無ければfnを始めるが、待たない
+// 待っているリクエストが全て切断されても、この処理は最後まで続ける
+func (g *sharedGroup) Go(key string, fn func(ctx context.Context) (interface{}, error)) {
+	call, _ := g.join(key, fn)
+	go func() {
+		<-call.done
+		g.leave(key, call)
+	}()
+}
@@ -1,22 +1,23 @@
 package provider
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	"io"
+	"expvar"
 	"mime"
 	"os"
-	"path"
-	"strings"
+	"runtime"
 	"time"
 
 	"github.com/nerikeshi-k/mono/config"
 	"github.com/nerikeshi-k/mono/env"
+	"github.com/nerikeshi-k/mono/hotcache"
 	"github.com/nerikeshi-k/mono/preprocess"
 	"github.com/nerikeshi-k/mono/recordstore"
 	"github.com/nerikeshi-k/mono/storageclient"
 	"github.com/nerikeshi-k/mono/util"
 	"golang.org/x/exp/slices"
+	"golang.org/x/sync/semaphore"
 
 	"go.uber.org/zap"
 )
@@ -27,80 +28,275 @@ var (
 
 	// ErrInternalServerError 処理中の予期せぬエラー
 	ErrInternalServerError = errors.New("internal server error")
+
+	// ErrGatewayTimeout originからの取得がタイムアウトした
+	ErrGatewayTimeout = errors.New("gateway timeout")
+
+	// ErrServiceUnavailable originへの失敗が続いていて取得を止めている
+	ErrServiceUnavailable = errors.New("service unavailable")
 )
 
+var (
+	// 同じblobへの同時のキャッシュミスをまとめてoriginへの取得を1回にする
+	fetchGroup sharedGroup
+
+	// 同時に行う画像加工の数の上限
+	transformSem = semaphore.NewWeighted(maxConcurrentTransforms())
+
+	stats = expvar.NewMap("provider")
+)
+
+func maxConcurrentTransforms() int64 {
+	if n := config.Get().MaxConcurrentTransforms; n > 0 {
+		return n
+	}
+	return int64(runtime.NumCPU())
+}
+
 // Product provideが返すもの
 type Product struct {
-	Data   []byte
-	Record *recordstore.Record
+	Data         []byte
+	Record       *recordstore.Record
+	Stale        bool   // 期限切れのキャッシュを返した
+	CacheControl string // 返すCache-Controlヘッダ
+}
+
+// 秒数が0より大きければタイムアウトつきのcontextを返す
+func withTimeout(ctx context.Context, seconds int64) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+// キャッシュ済みのRecordを探す。期限切れでもキャッシュファイルがあれば返す
+func lookupRecord(key string) (*recordstore.Record, error) {
+	record, err := recordstore.GetRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	if record.NotFound {
+		return nil, storageclient.ErrBlobNotFound
+	}
+	// メモリに載っていればディスクには触らない
+	if !hotcache.Has(record.CacheFileName) && !util.DoesFileExist(record.GetPath()) {
+		return nil, recordstore.ErrRecordNotFound
+	}
+	return record, nil
 }
 
-func fetchRecord(bucketName string, blobName string) (*recordstore.Record, error) {
+// Recordを返す。期限切れなら取得し直すが、猶予の間は期限切れのものを返すことがある
+// 期限切れのものを返したらstaleがtrueになる
+func fetchRecord(ctx context.Context, bucketName string, blobName string) (record *recordstore.Record, stale bool, err error) {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
 	key := recordstore.GenerateKey(bucketName, blobName)
-	record, err := recordstore.GetRecord(key)
-	if err == nil && util.DoesFileExist(record.GetPath()) {
+	now := time.Now()
+	record, err = lookupRecord(key)
+	if err == storageclient.ErrBlobNotFound {
+		stats.Add("negative_hits", 1)
+		return nil, false, err
+	}
+	if err == nil && !record.IsExpired(now) {
 		if env.DEBUG {
 			sugar.Debugw("cache hit")
 		}
-		record.LastRequestedAt = time.Now()
-		recordstore.SetRecord(key, record)
-		return record, nil
+		record.LastRequestedAt = now
+		recordstore.TouchRecord(key, record, now)
+		return record, false, nil
+	}
+
+	if err == nil {
+		stats.Add("cache_expired", 1)
+		// stale_while_revalidateの間は期限切れのものをすぐ返し、裏で取得し直す
+		if now.Before(record.ExpiresAt.Add(time.Duration(config.Get().StaleWhileRevalidate) * time.Second)) {
+			stats.Add("stale_while_revalidate", 1)
+			// よくリクエストされる期限切れのものが取得し直している間に追い出されないようにする
+			record.LastRequestedAt = now
+			recordstore.TouchRecord(key, record, now)
+			refreshInBackground(key, bucketName, blobName)
+			return record, true, nil
+		}
+	} else {
+		stats.Add("cache_misses", 1)
+		record = nil
+	}
+	val, shared, err := fetchGroup.Do(ctx, key, func(groupCtx context.Context) (interface{}, error) {
+		return refreshOnce(groupCtx, key, bucketName, blobName)
+	})
+	if shared {
+		stats.Add("deduplicated_fetches", 1)
+	}
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
 	}
-	// gcsからblocを取ってくる
-	blob, err := storageclient.FetchBlob(bucketName, blobName)
 	if err != nil {
-		sugar.Errorw("failed to fetch blob", "error", err)
+		// originから取れなくても、stale_if_errorの間は期限切れのものを返す
+		// 固定したものはいつまでも返す
+		if record != nil && err != storageclient.ErrBlobNotFound &&
+			(record.Pinned || now.Before(record.ExpiresAt.Add(time.Duration(config.Get().StaleIfError)*time.Second))) {
+			stats.Add("stale_if_error", 1)
+			sugar.Warnw("served stale record on error", "key", key, "error", err)
+			record.LastRequestedAt = now
+			recordstore.TouchRecord(key, record, now)
+			return record, true, nil
+		}
+		return nil, false, err
+	}
+	return val.(*recordstore.Record), false, nil
+}
+
+// 取得し直すのを始めるだけで待たない。同じblobを取得中なら何もしない
+func refreshInBackground(key string, bucketName string, blobName string) {
+	fetchGroup.Go(key, func(groupCtx context.Context) (interface{}, error) {
+		return refreshOnce(groupCtx, key, bucketName, blobName)
+	})
+}
+
+// fetchGroupの中で1回だけ取得し直す
+func refreshOnce(ctx context.Context, key string, bucketName string, blobName string) (interface{}, error) {
+	// 直前に他のリクエストが取得を終えていればそれを使う
+	record, err := lookupRecord(key)
+	if err == storageclient.ErrBlobNotFound {
 		return nil, err
 	}
-	// キャッシュ保存
+	if err == nil && !record.IsExpired(time.Now()) {
+		return record, nil
+	}
+	if err != nil {
+		record = nil
+	}
+	// ctxは相乗りした全リクエストで共有していて、全て切断されたときだけキャンセルされる
+	fetchCtx, cancel := withTimeout(ctx, config.Get().Timeouts.OriginFetch)
+	defer cancel()
+	record, err = refreshRecord(fetchCtx, key, bucketName, blobName, record)
+	if err != nil && (fetchCtx.Err() == context.DeadlineExceeded || errors.Is(err, storageclient.ErrOriginTimeout)) {
+		return nil, ErrGatewayTimeout
+	}
+	return record, err
+}
+
+// originでのblobがrecordを作ったときから変わっていなければtrue
+func isUnchanged(record *recordstore.Record, attrs *storageclient.Attrs) bool {
+	if record.Generation != 0 || attrs.Generation != 0 {
+		return record.Generation == attrs.Generation && record.Metageneration == attrs.Metageneration
+	}
+	if record.ETag != "" || attrs.ETag != "" {
+		return record.ETag == attrs.ETag
+	}
+	if !record.LastModified.IsZero() {
+		return record.LastModified.Equal(attrs.LastModified) && record.Size == attrs.Size
+	}
+	return false
+}
+
+// 期限切れのrecordがあればoriginで変わっていないか確かめて期限を延ばす
+// recordが無いか、originで変わっていればoriginから取得し直す
+func refreshRecord(ctx context.Context, key string, bucketName string, blobName string, record *recordstore.Record) (*recordstore.Record, error) {
+	if record != nil {
+		attrs, err := storageclient.StatBlob(ctx, bucketName, blobName)
+		if err != nil && err != storageclient.ErrBlobNotFound {
+			return nil, err
+		}
+		if err == nil && isUnchanged(record, attrs) {
+			stats.Add("revalidated", 1)
+			now := time.Now()
+			record.LastRequestedAt = now
+			record.CacheControl = attrs.CacheControl
+			expires, _ := cachePolicy(bucketName, blobName, record)
+			record.ExpiresAt = now.Add(expires)
+			recordstore.SetRecord(key, record)
+			return record, nil
+		}
+	}
+	stats.Add("origin_fetches", 1)
+	return fillRecord(ctx, key, bucketName, blobName)
+}
+
+// originからblobを取ってきてキャッシュし、Recordを作る
+func fillRecord(ctx context.Context, key string, bucketName string, blobName string) (*recordstore.Record, error) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	// originからblobを取ってきてキャッシュファイルに直接書き込む
 	now := time.Now()
 	cacheFileName := recordstore.GenerateCacheFileName()
-	fp, err := os.Create(path.Join(config.Get().CacheDirPath, cacheFileName))
+	fp, err := createCacheFile(cacheFileName)
 	if err != nil {
 		sugar.Errorw("failed to create cache file", "error", err)
 		return nil, err
 	}
-	defer fp.Close()
-	if _, err := io.Copy(fp, bytes.NewReader(blob.Data)); err != nil {
-		sugar.Errorw("failed to write cache file", "error", err)
+	blob, err := storageclient.FetchBlob(ctx, bucketName, blobName, fp)
+	if err != nil {
+		discardCacheFile(fp)
+		if err == storageclient.ErrBlobNotFound {
+			// しばらくoriginに問い合わせずに済むよう、無かったことを覚えておく
+			if config.Get().NegativeCacheExpires > 0 {
+				recordstore.SetRecord(key, &recordstore.Record{
+					BucketName:      bucketName,
+					BlobName:        blobName,
+					NotFound:        true,
+					LastRequestedAt: now,
+					CreatedAt:       now,
+					ExpiresAt:       now.Add(time.Duration(config.Get().NegativeCacheExpires) * time.Second),
+				})
+			}
+			return nil, err
+		}
+		sugar.Errorw("failed to fetch blob", "error", err)
 		return nil, err
 	}
 
 	// Record作成、保存
+	// 壊れたContent-Typeでもダウンロード済みのものは捨てずに、拡張子から推測する
 	mediatype, _, err := mime.ParseMediaType(blob.ContentType)
 	if err != nil {
-		sugar.Errorw("failed to parse content type", "error", err)
+		sugar.Warnw("failed to parse content type", "contentType", blob.ContentType, "error", err)
+		mediatype = util.PredictContentType(blobName)
+		if mediatype == "" {
+			mediatype = "application/octet-stream"
+		}
+	}
+	if err := commitCacheFile(fp, cacheFileName); err != nil {
+		sugar.Errorw("failed to commit cache file", "error", err)
 		return nil, err
 	}
 	newRecord := &recordstore.Record{
+		BucketName:      bucketName,
 		BlobName:        blobName,
 		CacheFileName:   cacheFileName,
 		Size:            blob.Size,
 		ContentType:     mediatype,
+		Checksum:        blob.Checksum,
+		ETag:            blob.ETag,
+		LastModified:    blob.LastModified,
+		Generation:      blob.Generation,
+		Metageneration:  blob.Metageneration,
+		CacheControl:    blob.CacheControl,
 		LastRequestedAt: now,
 		CreatedAt:       now,
 	}
-	recordstore.SetRecord(key, newRecord)
+	expires, _ := cachePolicy(bucketName, blobName, newRecord)
+	newRecord.ExpiresAt = now.Add(expires)
+	if err := recordstore.SetRecord(key, newRecord); err != nil {
+		os.Remove(newRecord.GetPath())
+		return nil, err
+	}
 	return newRecord, nil
 }
 
 func predictContentType(blobName string) (string, error) {
-	if strings.HasSuffix(blobName, ".png") {
-		return "image/png", nil
-	} else if strings.HasSuffix(blobName, ".jpeg") || strings.HasSuffix(blobName, ".jpg") {
-		return "image/jpeg", nil
-	} else if strings.HasSuffix(blobName, ".webp") {
-		return "image/webp", nil
-	} else {
+	contentType := util.PredictContentType(blobName)
+	if contentType == "" {
 		return "", ErrInternalServerError
 	}
+	return contentType, nil
 }
 
 // Provide bucketからblobを取ってきてProductにして返す
-func Provide(bucketName string, blobName string, query preprocess.Query) (*Product, error) {
+// ctxがキャンセルされた場合はctxのエラーを返す
+func Provide(ctx context.Context, bucketName string, blobName string, query preprocess.Query) (*Product, error) {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
@@ -116,42 +312,52 @@ func Provide(bucketName string, blobName string, query preprocess.Query) (*Produ
 		return nil, ErrNotFound
 	}
 
-	record, err := fetchRecord(bucketName, blobName)
-	if err != nil {
-		if err == storageclient.ErrBlobNotFound || err == storageclient.ErrBucketNotFound {
-			return nil, ErrNotFound
+	// 元画像のキャッシュファイルが壊れていたら、消したあと1度だけ取得し直す
+	for attempt := 0; ; attempt++ {
+		record, stale, err := fetchRecord(ctx, bucketName, blobName)
+		if err != nil {
+			if err == storageclient.ErrBlobNotFound || err == storageclient.ErrBucketNotFound {
+				return nil, ErrNotFound
+			}
+			if err == ErrGatewayTimeout {
+				return nil, ErrGatewayTimeout
+			}
+			if err == storageclient.ErrCircuitOpen {
+				return nil, ErrServiceUnavailable
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			sugar.Errorw("failed to fetch record process", "error", "err")
+			return nil, ErrInternalServerError
+		}
+		contentType := record.ContentType
+		if !slices.Contains(env.SUPPORTED_CONTENT_TYPES, contentType) {
+			predicted, err := predictContentType(blobName)
+			if err != nil {
+				return nil, err
+			}
+			contentType = predicted
+		}
+		key := recordstore.GenerateKey(bucketName, blobName)
+		data, err := provideVariant(ctx, key, record, contentType, query)
+		if err == errCorruptCache && attempt == 0 {
+			continue
 		}
-		sugar.Errorw("failed to fetch record process", "error", "err")
-		return nil, ErrInternalServerError
-	}
-	fp, err := os.Open(record.GetPath())
-	if err != nil {
-		sugar.Errorw("failed to open recorded cache data", "error", "err")
-		return nil, ErrInternalServerError
-	}
-	defer fp.Close()
-	data, err := io.ReadAll(fp)
-	if err != nil {
-		sugar.Errorw("failed to read", "error", "err")
-		return nil, ErrInternalServerError
-	}
-
-	contentType := record.ContentType
-	if !slices.Contains(env.SUPPORTED_CONTENT_TYPES, contentType) {
-		predicted, err := predictContentType(blobName)
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			sugar.Errorw("failed to pre-processe object", "error", err)
+			return nil, ErrInternalServerError
 		}
-		contentType = predicted
-	}
-	data, err = preprocess.ReduceImage(data, contentType, query)
-	if err != nil {
-		sugar.Errorw("failed to pre-processe object", "error", "err")
-		return nil, ErrInternalServerError
-	}
-	product := &Product{
-		Data:   data,
-		Record: record,
+		_, cacheControl := cachePolicy(bucketName, blobName, record)
+		product := &Product{
+			Data:         data,
+			Record:       record,
+			Stale:        stale,
+			CacheControl: cacheControl,
+		}
+		return product, nil
 	}
-	return product, nil
 }
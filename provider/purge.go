@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"os"
+
+	"github.com/nerikeshi-k/mono/hotcache"
+	"github.com/nerikeshi-k/mono/recordstore"
+	"go.uber.org/zap"
+)
+
+// PurgeBlob blobのキャッシュを、加工済みの画像のキャッシュと一緒に消す
+func PurgeBlob(bucketName string, blobName string) (*recordstore.PurgeResult, error) {
+	result, err := recordstore.PurgeBlob(bucketName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	removeCacheFiles(result.CacheFileNames)
+	return result, nil
+}
+
+// PurgePrefix blob名がprefixから始まるキャッシュを全て消す。prefixが空ならbucketの全て
+func PurgePrefix(bucketName string, prefix string) (*recordstore.PurgeResult, error) {
+	result, err := recordstore.PurgePrefix(bucketName, prefix)
+	if err != nil {
+		return nil, err
+	}
+	removeCacheFiles(result.CacheFileNames)
+	return result, nil
+}
+
+// gcを待たずにキャッシュファイルとメモリ上のキャッシュを消す
+func removeCacheFiles(cacheFileNames []string) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	for _, name := range cacheFileNames {
+		hotcache.Delete(name)
+		if err := os.Remove(recordstore.GetCachePath(name)); err != nil && !os.IsNotExist(err) {
+			sugar.Errorw("failed to remove file", "name", name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"context"
+	"hash/crc32"
+	"os"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/hotcache"
+	"github.com/nerikeshi-k/mono/preprocess"
+	"github.com/nerikeshi-k/mono/recordstore"
+	"github.com/nerikeshi-k/mono/util"
+	"go.uber.org/zap"
+)
+
+// 元画像recordから作られた加工済みの画像のRecordを探す
+func lookupVariant(variantKey string, record *recordstore.Record) (*recordstore.Record, error) {
+	variant, err := recordstore.GetRecord(variantKey)
+	if err != nil {
+		return nil, err
+	}
+	// 元画像が取得し直されていたら作り直す
+	if variant.SourceFileName != record.CacheFileName {
+		return nil, recordstore.ErrRecordNotFound
+	}
+	return variant, nil
+}
+
+// 加工済みの画像をキャッシュから返す。無ければ元画像を加工してキャッシュする
+func provideVariant(ctx context.Context, key string, record *recordstore.Record, contentType string, query preprocess.Query) ([]byte, error) {
+	variantKey := recordstore.GenerateVariantKey(key, query.Normalize())
+	if variant, err := lookupVariant(variantKey, record); err == nil {
+		if data, err := readCacheFile(variantKey, variant); err == nil {
+			stats.Add("variant_hits", 1)
+			// 元画像の期限が延びていれば加工済みの画像の期限も合わせる
+			variant.LastRequestedAt = time.Now()
+			variant.ExpiresAt = record.ExpiresAt
+			recordstore.TouchRecord(variantKey, variant, variant.LastRequestedAt)
+			return data, nil
+		}
+	}
+
+	stats.Add("variant_misses", 1)
+	val, _, err := fetchGroup.Do(ctx, variantKey, func(groupCtx context.Context) (interface{}, error) {
+		if variant, err := lookupVariant(variantKey, record); err == nil {
+			if data, err := readCacheFile(variantKey, variant); err == nil {
+				return data, nil
+			}
+		}
+		// 加工結果は相乗りした全リクエストで共有し、待っているリクエストが全て切断されたら止める
+		transformCtx, cancel := withTimeout(groupCtx, config.Get().Timeouts.Transform)
+		defer cancel()
+		return fillVariant(transformCtx, key, variantKey, record, contentType, query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
+
+// 画像加工をtransformSemの枠の中で別のgoroutineで行い、ctxが終わったら加工の終わりを待たずに返る
+// リサイズとwebpのデコードは途中で止まらないので、見捨てた加工もgoroutineが終わるまで枠を持ち続ける
+// CPUが詰まってタイムアウトが続いても、裏で走る加工は枠の数を超えない
+func reduceImage(ctx context.Context, data []byte, contentType string, query preprocess.Query) ([]byte, error) {
+	if err := transformSem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer transformSem.Release(1)
+		data, err := preprocess.ReduceImage(ctx, data, contentType, query)
+		ch <- result{data: data, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.data, r.err
+	}
+}
+
+// 元画像を加工してキャッシュし、加工結果を返す
+func fillVariant(ctx context.Context, key string, variantKey string, record *recordstore.Record, contentType string, query preprocess.Query) ([]byte, error) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	data, err := readCacheFile(key, record)
+	if err != nil {
+		return nil, err
+	}
+	data, err = reduceImage(ctx, data, contentType, query)
+	if err != nil {
+		return nil, err
+	}
+
+	outputContentType := query.EncodeTarget
+	if outputContentType == "" {
+		outputContentType = contentType
+	}
+	now := time.Now()
+	variant := &recordstore.Record{
+		BucketName:      record.BucketName,
+		BlobName:        record.BlobName,
+		CacheFileName:   recordstore.GenerateCacheFileName(),
+		Size:            int64(len(data)),
+		ContentType:     outputContentType,
+		Checksum:        crc32.Checksum(data, util.ChecksumTable),
+		Variant:         query.Normalize(),
+		SourceFileName:  record.CacheFileName,
+		LastRequestedAt: now,
+		CreatedAt:       now,
+		ExpiresAt:       record.ExpiresAt,
+	}
+	// キャッシュできなくても加工結果は返す
+	if err := writeCacheFile(variant.CacheFileName, data); err != nil {
+		sugar.Errorw("failed to write variant cache file", "error", err)
+		return data, nil
+	}
+	if err := recordstore.SetRecord(variantKey, variant); err != nil {
+		os.Remove(variant.GetPath())
+		return data, nil
+	}
+	hotcache.Set(variant.CacheFileName, data)
+	return data, nil
+}
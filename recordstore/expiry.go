@@ -0,0 +1,141 @@
+package recordstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// 期限のインデックス
+// "!exp/" + Recordを消す時刻(UnixNano, big endian) + Recordのキー を値なしで保存し、期限の早い順に辿れるようにする
+var expiryPrefix = []byte("!exp/")
+
+// Recordを消す時刻
+// 期限切れ後もoriginへの再検証や期限切れのまま返すのに使えるよう、キャッシュファイルのあるRecordはしばらく残しておく
+func deadline(record *Record) time.Time {
+	if record.NotFound {
+		return record.ExpiresAt
+	}
+	grace := config.Get().CacheRetention
+	if config.Get().StaleWhileRevalidate > grace {
+		grace = config.Get().StaleWhileRevalidate
+	}
+	if config.Get().StaleIfError > grace {
+		grace = config.Get().StaleIfError
+	}
+	return record.ExpiresAt.Add(time.Second * time.Duration(grace))
+}
+
+func expiryKey(key string, record *Record) []byte {
+	b := make([]byte, 0, len(expiryPrefix)+8+len(key))
+	b = append(b, expiryPrefix...)
+	// ExpiresAtの無いRecordはUnixNanoが負になって後ろに並んでしまうので、先頭に並べてすぐに消させる
+	nanos := deadline(record).UnixNano()
+	if record.ExpiresAt.IsZero() || nanos < 0 {
+		nanos = 0
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(nanos))
+	return append(b, key...)
+}
+
+// ExpiresAtの無いRecordにexpiryKeyがゼロ値のまま張っていたインデックスのキー
+func legacyExpiryKey(key string, record *Record) []byte {
+	b := make([]byte, 0, len(expiryPrefix)+8+len(key))
+	b = append(b, expiryPrefix...)
+	b = binary.BigEndian.AppendUint64(b, uint64(deadline(record).UnixNano()))
+	return append(b, key...)
+}
+
+// 固定したRecordは期限が切れても消さない
+func indexExpiry(txn *badger.Txn, key string, record *Record) error {
+	if record.Pinned {
+		return nil
+	}
+	return txn.Set(expiryKey(key, record), nil)
+}
+
+func unindexExpiry(txn *badger.Txn, key string, record *Record) error {
+	if record.Pinned {
+		return nil
+	}
+	return txn.Delete(expiryKey(key, record))
+}
+
+// 消す時刻がnowを過ぎているインデックスのキーを、早い順に最大size個返す
+func expiredIndexKeys(now time.Time, size int) ([][]byte, error) {
+	indexKeys := [][]byte{}
+	until := binary.BigEndian.AppendUint64(append([]byte{}, expiryPrefix...), uint64(now.UnixNano()))
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = expiryPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid() && len(indexKeys) < size; it.Next() {
+			if bytes.Compare(it.Item().Key()[:len(until)], until) > 0 {
+				break
+			}
+			indexKeys = append(indexKeys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	return indexKeys, err
+}
+
+// DeleteExpired 消す時刻を過ぎたRecordを消す
+// 消したRecordの数を返す。キャッシュファイルはgcが後で消す
+func DeleteExpired(now time.Time) (int, error) {
+	var count int
+	for {
+		indexKeys, err := expiredIndexKeys(now, evictBatchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(indexKeys) == 0 {
+			break
+		}
+		var batchCount int
+		err = update(func(txn *badger.Txn) error {
+			batchCount = 0
+			for _, indexKey := range indexKeys {
+				if err := txn.Delete(indexKey); err != nil {
+					return err
+				}
+				key := string(indexKey[len(expiryPrefix)+8:])
+				record, err := getRecordTxn(txn, key)
+				if err == ErrRecordNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				// 固定したものは消さない。固定する前か設定が変わる前のインデックスが残っていただけ
+				if record.Pinned {
+					continue
+				}
+				// 更新されて期限が延びていたら、今の期限でインデックスを張り直す
+				// cache_retentionの設定が変わってインデックスがずれた場合もここで直る
+				if deadline(record).After(now) {
+					if err := indexExpiry(txn, key, record); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := deleteRecordTxn(txn, key, record); err != nil {
+					return err
+				}
+				batchCount++
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count += batchCount
+	}
+	return count, nil
+}
@@ -0,0 +1,55 @@
+package recordstore
+
+import (
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// キャッシュファイル名からRecordを引くインデックス
+// "!file/" + キャッシュファイル名 に Recordのキー を保存し、どこからも参照されていないファイルを1つずつ確かめられるようにする
+var filePrefix = []byte("!file/")
+
+func fileKey(cacheFileName string) []byte {
+	return append(append([]byte{}, filePrefix...), cacheFileName...)
+}
+
+func indexFile(txn *badger.Txn, key string, record *Record) error {
+	if record.NotFound {
+		return nil
+	}
+	return txn.Set(fileKey(record.CacheFileName), []byte(key))
+}
+
+func unindexFile(txn *badger.Txn, record *Record) error {
+	if record.NotFound {
+		return nil
+	}
+	return txn.Delete(fileKey(record.CacheFileName))
+}
+
+// IsCacheFileReferenced キャッシュファイルを参照しているRecordがあればtrue
+func IsCacheFileReferenced(cacheFileName string) (bool, error) {
+	referenced := false
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(fileKey(cacheFileName))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		record, err := getRecordTxn(txn, string(key))
+		if err == ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		referenced = !record.NotFound && record.CacheFileName == cacheFileName
+		return nil
+	})
+	return referenced, err
+}
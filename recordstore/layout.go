@@ -0,0 +1,49 @@
+package recordstore
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/nerikeshi-k/mono/config"
+)
+
+// キャッシュファイルは名前の先頭4文字で2段に分けたディレクトリに置く
+// 例: 0f3a9c12-... -> CacheDirPath/0f/3a/0f3a9c12-...
+const shardNameLength = 2
+
+// ShardCount 1段目(と2段目)のディレクトリの数
+const ShardCount = 256
+
+// GetCachePath キャッシュファイル名から実体のパスを返す
+func GetCachePath(cacheFileName string) string {
+	if len(cacheFileName) < shardNameLength*2 {
+		return filepath.Join(config.Get().CacheDirPath, cacheFileName)
+	}
+	return filepath.Join(
+		config.Get().CacheDirPath,
+		cacheFileName[:shardNameLength],
+		cacheFileName[shardNameLength:shardNameLength*2],
+		cacheFileName,
+	)
+}
+
+// GetTempPath キャッシュファイルを書き込む途中の一時ファイルのパスを返す
+// renameできるよう本来のパスと同じディレクトリに置く
+func GetTempPath(cacheFileName string) string {
+	return GetCachePath(cacheFileName) + ".tmp"
+}
+
+// MakeCacheDir キャッシュファイルを置くディレクトリを作る
+func MakeCacheDir(cacheFileName string) error {
+	return os.MkdirAll(filepath.Dir(GetCachePath(cacheFileName)), 0755)
+}
+
+// GetShardPath 1段目のディレクトリのパスを返す
+func GetShardPath(shard int) string {
+	return filepath.Join(config.Get().CacheDirPath, shardName(shard))
+}
+
+func shardName(shard int) string {
+	const hex = "0123456789abcdef"
+	return string([]byte{hex[shard/16%16], hex[shard%16]})
+}
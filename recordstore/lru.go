@@ -0,0 +1,249 @@
+package recordstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// LRUのインデックス
+// "!lru/" + LastRequestedAt(UnixNano, big endian) + Recordのキー を値なしで保存し、キー順に古いものから辿れるようにする
+var lruPrefix = []byte("!lru/")
+
+const evictBatchSize = 100
+
+func lruKey(key string, lastRequestedAt time.Time) []byte {
+	b := make([]byte, 0, len(lruPrefix)+8+len(key))
+	b = append(b, lruPrefix...)
+	b = binary.BigEndian.AppendUint64(b, uint64(lastRequestedAt.UnixNano()))
+	return append(b, key...)
+}
+
+func indexLRU(txn *badger.Txn, key string, record *Record) error {
+	// キャッシュファイルの無いRecordは消しても空かないので対象にしない
+	// 固定したRecordは追い出さない
+	if record.NotFound || record.Pinned {
+		return nil
+	}
+	return txn.Set(lruKey(key, record.LastRequestedAt), nil)
+}
+
+func unindexLRU(txn *badger.Txn, key string, record *Record) error {
+	if record.NotFound || record.Pinned {
+		return nil
+	}
+	return txn.Delete(lruKey(key, record.LastRequestedAt))
+}
+
+// リクエストのたびにKVSへ書かないよう、LastRequestedAtの更新はメモリに貯めてtouchFlushIntervalごとにまとめて書く
+// 同じRecordへの何度ものリクエストは1回の書き込みになる
+const touchFlushInterval = 5 * time.Second
+
+type touch struct {
+	cacheFileName   string
+	lastRequestedAt time.Time
+	expiresAt       time.Time
+}
+
+var (
+	touchMu sync.Mutex
+	// まだKVSに書いていない更新 Recordのキー -> 更新
+	pendingTouches = map[string]touch{}
+)
+
+// TouchRecord recordを返したことをLastRequestedAtに記録する。record.ExpiresAtの方が後なら期限も延ばす
+// KVSへはまとめて後で書く。消されたRecordを作り直したり、裏で取得し直したRecordを古いもので上書きしたりしないよう、
+// 書くときに保存されているRecordが同じキャッシュファイルを指しているときだけ更新する
+func TouchRecord(key string, record *Record, now time.Time) {
+	touchMu.Lock()
+	defer touchMu.Unlock()
+	t, ok := pendingTouches[key]
+	if !ok || t.cacheFileName != record.CacheFileName {
+		t = touch{cacheFileName: record.CacheFileName}
+	}
+	if now.After(t.lastRequestedAt) {
+		t.lastRequestedAt = now
+	}
+	if record.ExpiresAt.After(t.expiresAt) {
+		t.expiresAt = record.ExpiresAt
+	}
+	pendingTouches[key] = t
+}
+
+// 貯めておいた更新をevictBatchSize件ずつKVSに書き、更新したRecordの数を返す
+func flushTouches() (int, error) {
+	touchMu.Lock()
+	touches := pendingTouches
+	pendingTouches = map[string]touch{}
+	touchMu.Unlock()
+
+	keys := make([]string, 0, len(touches))
+	for key := range touches {
+		keys = append(keys, key)
+	}
+	count := 0
+	for start := 0; start < len(keys); start += evictBatchSize {
+		batch := keys[start:min(start+evictBatchSize, len(keys))]
+		var batchCount int
+		err := update(func(txn *badger.Txn) error {
+			batchCount = 0
+			for _, key := range batch {
+				t := touches[key]
+				stored, err := getRecordTxn(txn, key)
+				if err == ErrRecordNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if stored.CacheFileName != t.cacheFileName || !t.lastRequestedAt.After(stored.LastRequestedAt) {
+					continue
+				}
+				stored.LastRequestedAt = t.lastRequestedAt
+				if t.expiresAt.After(stored.ExpiresAt) {
+					stored.ExpiresAt = t.expiresAt
+				}
+				if _, err := setRecordTxn(txn, key, stored); err != nil {
+					return err
+				}
+				batchCount++
+			}
+			return nil
+		})
+		// 書けなかった更新は捨てる 追い出しの順番が少しずれるだけ
+		if err != nil {
+			return count, err
+		}
+		count += batchCount
+	}
+	return count, nil
+}
+
+// touchFlushIntervalごとに貯めておいた更新をKVSに書く
+func flushTouchesPeriodically() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	ticker := time.NewTicker(touchFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopFlush:
+			return
+		case <-ticker.C:
+			if _, err := flushTouches(); err != nil {
+				sugar.Errorw("failed to flush record touches", "error", err)
+			}
+		}
+	}
+}
+
+// 最後にリクエストされたのが古い順に、最大size個のインデックスのキーを返す
+func oldestIndexKeys(size int) ([][]byte, error) {
+	indexKeys := [][]byte{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = lruPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid() && len(indexKeys) < size; it.Next() {
+			if it.Item().IsDeletedOrExpired() {
+				continue
+			}
+			indexKeys = append(indexKeys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	return indexKeys, err
+}
+
+// 元画像のRecordを消すときは、そこから作った加工済みの画像のRecordも消す
+func variantKeysTxn(txn *badger.Txn, key string) []string {
+	keys := []string{}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(GenerateVariantKey(key, ""))
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Item().KeyCopy(nil)))
+	}
+	return keys
+}
+
+// EvictLeastRecentlyUsed 最後にリクエストされたのが古いRecordから、合計サイズがsizeを超えるまで消す
+// 元画像を消すときはそこから作った加工済みの画像も消す
+// 消したRecordの数と合計サイズを返す。キャッシュファイルはgcが後で消す
+func EvictLeastRecentlyUsed(size int64) (int, int64, error) {
+	var count int
+	var freed int64
+	// 最近リクエストされたものを古いと見誤らないよう、貯めておいた更新を先に書く
+	if _, err := flushTouches(); err != nil {
+		return count, freed, err
+	}
+	for freed < size {
+		indexKeys, err := oldestIndexKeys(evictBatchSize)
+		if err != nil {
+			return count, freed, err
+		}
+		if len(indexKeys) == 0 {
+			break
+		}
+		var batchCount int
+		var batchFreed int64
+		err = update(func(txn *badger.Txn) error {
+			batchCount = 0
+			batchFreed = 0
+			for _, indexKey := range indexKeys {
+				if freed+batchFreed >= size {
+					break
+				}
+				if err := txn.Delete(indexKey); err != nil {
+					return err
+				}
+				key := string(indexKey[len(lruPrefix)+8:])
+				record, err := getRecordTxn(txn, key)
+				if err == ErrRecordNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				// 古いインデックスが残っていただけなら消すだけにする
+				if !bytes.Equal(lruKey(key, record.LastRequestedAt), indexKey) {
+					continue
+				}
+				targets := []string{key}
+				if record.Variant == "" {
+					targets = append(targets, variantKeysTxn(txn, key)...)
+				}
+				for _, target := range targets {
+					record, err := getRecordTxn(txn, target)
+					if err == ErrRecordNotFound {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					if err := deleteRecordTxn(txn, target, record); err != nil {
+						return err
+					}
+					batchCount++
+					batchFreed += record.Size
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return count, freed, err
+		}
+		count += batchCount
+		freed += batchFreed
+	}
+	return count, freed, nil
+}
@@ -0,0 +1,151 @@
+package recordstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// CacheDirPath直下に置いていた頃のキャッシュファイルを分けたディレクトリに移す
+// 数百万ファイルあっても全部をメモリに載せないよう、少しずつ読む
+func migrateFlatLayout() (int, error) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	dir, err := os.Open(config.Get().CacheDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer dir.Close()
+
+	moved := 0
+	for {
+		entries, err := dir.ReadDir(1000)
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || len(name) < shardNameLength*2 {
+				continue
+			}
+			if err := MakeCacheDir(name); err != nil {
+				return moved, err
+			}
+			from := filepath.Join(config.Get().CacheDirPath, name)
+			if err := os.Rename(from, GetCachePath(name)); err != nil {
+				sugar.Errorw("failed to move cache file", "name", name, "error", err)
+				continue
+			}
+			moved++
+		}
+		if err == io.EOF {
+			return moved, nil
+		}
+		if err != nil {
+			return moved, err
+		}
+	}
+}
+
+// Migrate 古いバージョンで保存したRecordのインデックスを張り直す
+// badgerのTTLで期限を管理していた頃のものはTTL無し + 期限のインデックスに移し、
+// キャッシュファイル名のインデックスが無いものには張る
+// キャッシュファイル名のインデックスが無いと孤立したファイルと見なされるので、gcを始める前に呼ぶ
+func Migrate() (int, error) {
+	keys := []string{}
+	// Recordのキー -> badgerのTTLでの期限(Unix秒) 0ならTTL無し
+	ttls := map[string]uint64{}
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if isInternalKey(it.Item().Key()) {
+				continue
+			}
+			if it.Item().ExpiresAt() == 0 {
+				var record Record
+				err := it.Item().Value(func(data []byte) error {
+					return record.UnmarshalBinary(data)
+				})
+				if err != nil {
+					return err
+				}
+				if record.NotFound {
+					continue
+				}
+				_, err = txn.Get(fileKey(record.CacheFileName))
+				if err != badger.ErrKeyNotFound && !record.ExpiresAt.IsZero() {
+					continue
+				}
+			}
+			key := string(it.Item().KeyCopy(nil))
+			keys = append(keys, key)
+			ttls[key] = it.Item().ExpiresAt()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(keys); start += evictBatchSize {
+		end := start + evictBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := update(func(txn *badger.Txn) error {
+			for _, key := range keys[start:end] {
+				record, err := getRecordTxn(txn, key)
+				if err == ErrRecordNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				// 古いRecordにはExpiresAtが無いので、badgerのTTLか作られた時刻から決める
+				if record.ExpiresAt.IsZero() {
+					// ExpiresAtの無いまま移した版で張った、期限のインデックスを消す
+					if err := txn.Delete(legacyExpiryKey(key, record)); err != nil {
+						return err
+					}
+					if ttls[key] > 0 {
+						record.ExpiresAt = time.Unix(int64(ttls[key]), 0)
+					} else {
+						createdAt := record.CreatedAt
+						if createdAt.IsZero() {
+							createdAt = time.Now()
+						}
+						record.ExpiresAt = createdAt.Add(time.Duration(config.Get().CacheExpires) * time.Second)
+					}
+				}
+				bin, err := record.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				if err := txn.Set([]byte(key), bin); err != nil {
+					return err
+				}
+				if err := indexLRU(txn, key, record); err != nil {
+					return err
+				}
+				if err := indexExpiry(txn, key, record); err != nil {
+					return err
+				}
+				if err := indexFile(txn, key, record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,209 @@
+package recordstore
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// 管理用のAPIで固定したblob
+// "!pin/" + bucket名 + "\x00" + blob名 + "\x00" + prefix に config.Pin のjsonを保存する
+var pinPrefix = []byte("!pin/")
+
+var (
+	// ErrPinInConfig 設定ファイルで固定したものは管理用のAPIでは外せない
+	ErrPinInConfig = errors.New("pin is defined in config")
+	// ErrPinNotFound 固定していない
+	ErrPinNotFound = errors.New("pin not found")
+)
+
+// Pin 固定したblob
+type Pin struct {
+	config.Pin
+	Configured bool `json:"configured"` // 設定ファイルで固定したもの
+}
+
+var (
+	pinsMu sync.RWMutex
+	pins   []Pin
+
+	applyPinsMu sync.Mutex
+)
+
+func pinKey(pin config.Pin) []byte {
+	return []byte(string(pinPrefix) + pin.Bucket + "\x00" + pin.Blob + "\x00" + pin.Prefix)
+}
+
+// 設定ファイルとKVSから固定したblobを読み込む
+func loadPins() error {
+	loaded := []Pin{}
+	for _, pin := range config.Get().Pins {
+		loaded = append(loaded, Pin{Pin: pin, Configured: true})
+	}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = pinPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var pin config.Pin
+			err := it.Item().Value(func(data []byte) error {
+				return json.Unmarshal(data, &pin)
+			})
+			if err != nil {
+				return err
+			}
+			loaded = append(loaded, Pin{Pin: pin})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	pinsMu.Lock()
+	pins = loaded
+	pinsMu.Unlock()
+	return nil
+}
+
+func pinMatches(pin config.Pin, key string, record *Record) bool {
+	if pin.Blob != "" && record.BlobName != pin.Blob {
+		return false
+	}
+	if !strings.HasPrefix(record.BlobName, pin.Prefix) {
+		return false
+	}
+	// bucket名を保存していなかった頃のRecordもあるので、キーからbucketを確かめる
+	return record.BucketName == pin.Bucket || originalKey(key) == GenerateKey(pin.Bucket, record.BlobName)
+}
+
+// 固定したblobのRecordならtrue。加工済みの画像のRecordも元画像と同じく固定する
+func isPinned(key string, record *Record) bool {
+	pinsMu.RLock()
+	defer pinsMu.RUnlock()
+	for _, pin := range pins {
+		if pinMatches(pin.Pin, key, record) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPins 固定したblobの一覧を返す
+func GetPins() []Pin {
+	pinsMu.RLock()
+	defer pinsMu.RUnlock()
+	return append([]Pin{}, pins...)
+}
+
+// AddPin blobを固定する。既にあるRecordへはバックグラウンドで反映する
+func AddPin(pin config.Pin) error {
+	bin, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	if err := update(func(txn *badger.Txn) error {
+		return txn.Set(pinKey(pin), bin)
+	}); err != nil {
+		return err
+	}
+	if err := loadPins(); err != nil {
+		return err
+	}
+	go applyPinsInBackground()
+	return nil
+}
+
+// RemovePin blobの固定を外す。既にあるRecordへはバックグラウンドで反映する
+func RemovePin(pin config.Pin) error {
+	for _, p := range GetPins() {
+		if p.Configured && p.Pin == pin {
+			return ErrPinInConfig
+		}
+	}
+	err := update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(pinKey(pin)); err != nil {
+			if err == badger.ErrKeyNotFound {
+				return ErrPinNotFound
+			}
+			return err
+		}
+		return txn.Delete(pinKey(pin))
+	})
+	if err != nil {
+		return err
+	}
+	if err := loadPins(); err != nil {
+		return err
+	}
+	go applyPinsInBackground()
+	return nil
+}
+
+// 全てのRecordを走査するので、管理用APIのリクエストを待たせないようにgoroutineで呼ぶ
+func applyPinsInBackground() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	// 続けて固定や解除が来ても走査が重ならないようにする。後から始めた走査が最新の一覧を反映する
+	applyPinsMu.Lock()
+	defer applyPinsMu.Unlock()
+	start := time.Now()
+	changed, err := ApplyPins()
+	if err != nil {
+		sugar.Errorw("failed to apply pins", "changedRecords", changed, "error", err)
+		return
+	}
+	sugar.Infow("applied pins", "changedRecords", changed, "elapsed", time.Since(start).String())
+}
+
+// ApplyPins 固定したblobの一覧が変わったのを既にあるRecordに反映する。固定したか外したRecordの数を返す
+// 固定したRecordの予算を超えるものは固定しない
+func ApplyPins() (int, error) {
+	changed := 0
+	after := ""
+	for {
+		records, err := recordsAfter(after, reconcilePageSize)
+		if err != nil {
+			return changed, err
+		}
+		if len(records) == 0 {
+			return changed, nil
+		}
+		after = records[len(records)-1].key
+		for _, r := range records {
+			if r.record.NotFound || isPinned(r.key, r.record) == r.record.Pinned {
+				continue
+			}
+			toggled := false
+			err := update(func(txn *badger.Txn) error {
+				record, err := getRecordTxn(txn, r.key)
+				if err == ErrRecordNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				wasPinned := record.Pinned
+				if _, err := setRecordTxn(txn, r.key, record); err != nil {
+					return err
+				}
+				toggled = wasPinned != record.Pinned
+				return nil
+			})
+			if err != nil {
+				return changed, err
+			}
+			if toggled {
+				changed++
+			}
+		}
+	}
+}
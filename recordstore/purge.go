@@ -0,0 +1,128 @@
+package recordstore
+
+import (
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// PurgeResult 消したRecordの数と合計サイズ
+type PurgeResult struct {
+	Originals      int      `json:"originals"`  // 元画像のRecord
+	Variants       int      `json:"variants"`   // 加工済みの画像のRecord
+	NotFounds      int      `json:"not_founds"` // originに無かったことを示すRecord
+	Size           int64    `json:"size"`
+	CacheFileNames []string `json:"-"` // 消したRecordが参照していたキャッシュファイル
+}
+
+func (r *PurgeResult) add(record *Record) {
+	switch {
+	case record.NotFound:
+		r.NotFounds++
+	case record.Variant != "":
+		r.Variants++
+	default:
+		r.Originals++
+	}
+	if !record.NotFound {
+		r.Size += record.Size
+		r.CacheFileNames = append(r.CacheFileNames, record.CacheFileName)
+	}
+}
+
+// 加工済みの画像のRecordのキーから元画像のRecordのキーを返す
+func originalKey(key string) string {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func purgeKeys(keys []string) (*PurgeResult, error) {
+	result := &PurgeResult{}
+	for start := 0; start < len(keys); start += evictBatchSize {
+		end := start + evictBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var batch *PurgeResult
+		err := update(func(txn *badger.Txn) error {
+			batch = &PurgeResult{}
+			for _, key := range keys[start:end] {
+				record, err := getRecordTxn(txn, key)
+				if err == ErrRecordNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := deleteRecordTxn(txn, key, record); err != nil {
+					return err
+				}
+				batch.add(record)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Originals += batch.Originals
+		result.Variants += batch.Variants
+		result.NotFounds += batch.NotFounds
+		result.Size += batch.Size
+		result.CacheFileNames = append(result.CacheFileNames, batch.CacheFileNames...)
+	}
+	return result, nil
+}
+
+// PurgeBlob bucketNameのbucketのblobNameのRecordを、そこから作った加工済みの画像のRecordと一緒に消す
+// キャッシュファイルは消さないので、呼び出し側でPurgeResult.CacheFileNamesを消す
+func PurgeBlob(bucketName string, blobName string) (*PurgeResult, error) {
+	key := GenerateKey(bucketName, blobName)
+	keys := []string{key}
+	err := db.View(func(txn *badger.Txn) error {
+		keys = append(keys, variantKeysTxn(txn, key)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purgeKeys(keys)
+}
+
+// PurgePrefix bucketNameのbucketで、blob名がprefixから始まるRecordを全て消す。prefixが空ならbucketの全て
+// Recordのキーはハッシュなので全てのRecordを走査する
+// キャッシュファイルは消さないので、呼び出し側でPurgeResult.CacheFileNamesを消す
+func PurgePrefix(bucketName string, prefix string) (*PurgeResult, error) {
+	keys := []string{}
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if isInternalKey(it.Item().Key()) {
+				continue
+			}
+			var record Record
+			err := it.Item().Value(func(data []byte) error {
+				return record.UnmarshalBinary(data)
+			})
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(record.BlobName, prefix) {
+				continue
+			}
+			// bucket名を保存していなかった頃のRecordもあるので、キーからbucketを確かめる
+			key := string(it.Item().KeyCopy(nil))
+			if originalKey(key) != GenerateKey(bucketName, record.BlobName) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purgeKeys(keys)
+}
@@ -0,0 +1,96 @@
+package recordstore
+
+import (
+	"context"
+	"os"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"golang.org/x/time/rate"
+)
+
+// 1回のトランザクションで読むRecordの数
+const reconcilePageSize = 1000
+
+type keyedRecord struct {
+	key    string
+	record *Record
+}
+
+// afterから後のRecordを最大size個返す。afterが空なら最初から
+func recordsAfter(after string, size int) ([]keyedRecord, error) {
+	records := []keyedRecord{}
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte(after)); it.Valid() && len(records) < size; it.Next() {
+			key := string(it.Item().Key())
+			if key == after || isInternalKey(it.Item().Key()) {
+				continue
+			}
+			var record Record
+			err := it.Item().Value(func(data []byte) error {
+				return record.UnmarshalBinary(data)
+			})
+			if err != nil {
+				return err
+			}
+			records = append(records, keyedRecord{key: key, record: &record})
+		}
+		return nil
+	})
+	return records, err
+}
+
+// DropDanglingRecords キャッシュファイルが無くなっているRecordを消す
+// ディスクに負担をかけないよう、limiterの頻度でファイルを確かめる
+// 確かめたRecordの数と消した数を返す
+func DropDanglingRecords(limiter *rate.Limiter) (int, int, error) {
+	checked := 0
+	dropped := 0
+	after := ""
+	for {
+		records, err := recordsAfter(after, reconcilePageSize)
+		if err != nil {
+			return checked, dropped, err
+		}
+		if len(records) == 0 {
+			return checked, dropped, nil
+		}
+		after = records[len(records)-1].key
+		for _, r := range records {
+			if r.record.NotFound {
+				continue
+			}
+			if err := limiter.Wait(context.Background()); err != nil {
+				return checked, dropped, err
+			}
+			checked++
+			if _, err := os.Stat(r.record.GetPath()); err == nil {
+				continue
+			}
+			deleted := false
+			err := update(func(txn *badger.Txn) error {
+				deleted = false
+				record, err := getRecordTxn(txn, r.key)
+				if err == ErrRecordNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				// 確かめている間に取得し直されていたら消さない
+				if record.CacheFileName != r.record.CacheFileName {
+					return nil
+				}
+				deleted = true
+				return deleteRecordTxn(txn, r.key, record)
+			})
+			if err != nil {
+				return checked, dropped, err
+			}
+			if deleted {
+				dropped++
+			}
+		}
+	}
+}
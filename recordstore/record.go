@@ -2,20 +2,34 @@ package recordstore
 
 import (
 	"encoding/json"
-	"path"
 	"time"
-
-	"github.com/nerikeshi-k/mono/config"
 )
 
 // Record storeに保存するデータ
 type Record struct {
-	BlobName        string    `json:"blob_name"`       // GCSのbucket内での名前
-	CacheFileName   string    `json:"cache_file_name"` // キャッシュのファイル名 UUID
-	Size            int64     `json:"size"`            // ファイルサイズ
-	ContentType     string    `json:"content_type"`    // ContentType
+	BucketName      string    `json:"bucket_name"`      // 設定上のbucket名
+	BlobName        string    `json:"blob_name"`        // GCSのbucket内での名前
+	CacheFileName   string    `json:"cache_file_name"`  // キャッシュのファイル名 UUID
+	Size            int64     `json:"size"`             // ファイルサイズ
+	ContentType     string    `json:"content_type"`     // ContentType
+	Checksum        uint32    `json:"checksum"`         // キャッシュファイルの中身のcrc32 (Castagnoli) 0なら検証しない
+	NotFound        bool      `json:"not_found"`        // originに無かったことを示すだけのRecord キャッシュファイルは無い
+	ETag            string    `json:"etag"`             // originでのETag
+	LastModified    time.Time `json:"last_modified"`    // originでの更新日時
+	Generation      int64     `json:"generation"`       // gcsのgeneration
+	Metageneration  int64     `json:"metageneration"`   // gcsのmetageneration
+	Variant         string    `json:"variant"`          // 加工済みの画像のRecordなら正規化したpreprocess.Query
+	SourceFileName  string    `json:"source_file_name"` // 加工済みの画像のRecordなら加工元のキャッシュファイル名
+	Pinned          bool      `json:"pinned"`           // 固定したRecord 追い出さず、期限が切れても消さない
+	CacheControl    string    `json:"cache_control"`    // originのblobに設定されたCache-Control
 	LastRequestedAt time.Time `json:"last_requested_at"`
 	CreatedAt       time.Time `json:"created_at"`
+	ExpiresAt       time.Time `json:"expires_at"` // これを過ぎたらoriginに変更がないか確かめる
+}
+
+// IsExpired 有効期限が切れていればtrue
+func (r *Record) IsExpired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
 }
 
 // MarshalBinary Record -> json
@@ -32,5 +46,5 @@ func (r *Record) UnmarshalBinary(data []byte) error {
 
 // GetPath キャッシュの実体のパスを返す
 func (r *Record) GetPath() string {
-	return path.Join(config.Get().CacheDirPath, r.CacheFileName)
+	return GetCachePath(r.CacheFileName)
 }
@@ -1,6 +1,7 @@
 package recordstore
 
 import (
+	"bytes"
 	"time"
 
 	"crypto/md5"
@@ -9,12 +10,13 @@ import (
 	"github.com/nerikeshi-k/mono/config"
 	"github.com/nerikeshi-k/mono/util"
 
-	set "github.com/deckarep/golang-set"
 	badger "github.com/dgraph-io/badger/v4"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+const maxConflictRetries = 10
+
 var (
 	db *badger.DB
 	// ErrRecordNotFound キーをもとにストアを探したがレコードがなかった
@@ -30,10 +32,32 @@ func init() {
 	if err != nil {
 		sugar.Fatalw("Failed to open database", "error", err)
 	}
+	if err := loadPins(); err != nil {
+		sugar.Fatalw("Failed to load pins", "error", err)
+	}
+	go flushSizesPeriodically()
+	go flushTouchesPeriodically()
+	moved, err := migrateFlatLayout()
+	if err != nil {
+		sugar.Fatalw("Failed to migrate cache files", "error", err)
+	}
+	if moved > 0 {
+		sugar.Infow("migrated cache files to sharded directories", "count", moved)
+	}
 }
 
 // Close DBをクローズする
 func Close() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	close(stopFlush)
+	if _, err := flushTouches(); err != nil {
+		sugar.Errorw("failed to flush record touches", "error", err)
+	}
+	if err := flushSizes(); err != nil {
+		sugar.Errorw("failed to flush cache usage", "error", err)
+	}
 	db.Close()
 }
 
@@ -45,41 +69,102 @@ func GenerateKey(bucketName string, blobName string) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// GenerateVariantKey 元画像のkeyと正規化したpreprocess.Queryから加工済みの画像のkeyを作る
+// 元画像のkeyがprefixになるので、元画像と一緒にまとめて消せる
+func GenerateVariantKey(key string, variant string) string {
+	return key + ":" + variant
+}
+
 // GenerateCacheFileName UUIDを返すだけ
 func GenerateCacheFileName() string {
 	return util.GenerateUUID()
 }
 
+// internalPrefix Record以外の管理用のキーにつけるprefix
+// Recordのキーはhexなのでこれで始まることはない
+var internalPrefix = []byte("!")
+
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, internalPrefix)
+}
+
+func getRecordTxn(txn *badger.Txn, key string) (*Record, error) {
+	item, err := txn.Get([]byte(key))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	var record Record
+	err = item.Value(func(data []byte) error {
+		return record.UnmarshalBinary(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
 // GetRecord KVSからRecordを探して返す、なければnilとerrorを返す
 func GetRecord(key string) (*Record, error) {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
-	var data []byte
+	var record *Record
 	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+		var err error
+		record, err = getRecordTxn(txn, key)
 		if err != nil {
 			return err
 		}
-		data, err = item.ValueCopy(nil)
-		if err != nil {
-			return err
+		// gcがまだ消していないだけのものは無いものとして扱う
+		if !record.Pinned && !deadline(record).After(time.Now()) {
+			return ErrRecordNotFound
 		}
 		return nil
 	})
 	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return nil, ErrRecordNotFound
+		if err != ErrRecordNotFound {
+			sugar.Errorw("failed to get record", "error", err)
 		}
-		sugar.Errorw("failed to get item", "error", err)
 		return nil, err
 	}
-	var record Record
-	if err := record.UnmarshalBinary(data); err != nil {
-		sugar.Errorw("failed to parse record", "error", err)
-		return nil, err
+	return record, nil
+}
+
+// 同じキーへの同時の更新で衝突したらやり直す
+func update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		var current *badger.Txn
+		err = db.Update(func(txn *badger.Txn) error {
+			current = txn
+			return fn(txn)
+		})
+		finishSizesTxn(current, err == nil)
+		if err != badger.ErrConflict {
+			return err
+		}
 	}
-	return &record, nil
+	return err
+}
+
+// Recordとそのインデックスを消し、使用量から差し引く
+func deleteRecordTxn(txn *badger.Txn, key string, record *Record) error {
+	if err := unindexLRU(txn, key, record); err != nil {
+		return err
+	}
+	if err := unindexExpiry(txn, key, record); err != nil {
+		return err
+	}
+	if err := unindexFile(txn, record); err != nil {
+		return err
+	}
+	if err := addSizeTxn(txn, record, -1); err != nil {
+		return err
+	}
+	return txn.Delete([]byte(key))
 }
 
 // SetRecord KVSにRecordをセットする
@@ -87,101 +172,112 @@ func SetRecord(key string, record *Record) error {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
-	err := db.Update(func(txn *badger.Txn) error {
-		bin, err := record.MarshalBinary()
-		if err != nil {
-			return err
-		}
-		entry := badger.NewEntry([]byte(key), bin).WithTTL(time.Second * time.Duration(config.Get().CacheExpires))
-		err = txn.SetEntry(entry)
-		if err != nil {
-			return err
-		}
-		return nil
+	overBudget := false
+	err := update(func(txn *badger.Txn) error {
+		var err error
+		overBudget, err = setRecordTxn(txn, key, record)
+		return err
 	})
 	if err != nil {
 		sugar.Errorw("failed set record", "error", err)
 		return err
 	}
+	if overBudget {
+		sugar.Warnw("pinned record exceeds max_pinned_volume, cached without pinning", "key", key, "blob", record.BlobName)
+	}
 	return nil
 }
 
-// RunGC badgerのGCを走らせる
-func RunGC() error {
-	return db.RunValueLogGC(0.7)
-}
-
-// GetKeys 指定サイズ分のキーをiterateして返す
-// size 0なら全て
-func GetKeys(size int64) (set.Set, error) {
-	var count int64
-	keys := set.NewSet()
-
-	err := db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		for it.Rewind(); it.Valid() && (size == 0 || count < size); it.Next() {
-			if it.Item().IsDeletedOrExpired() {
-				continue
+// Recordをセットし、インデックスと集計を更新する
+// 固定するblobならrecord.Pinnedをtrueにする。固定したRecordの予算を超えるなら固定せずにoverBudgetを返す
+func setRecordTxn(txn *badger.Txn, key string, record *Record) (overBudget bool, err error) {
+	old, err := getRecordTxn(txn, key)
+	if err != nil && err != ErrRecordNotFound {
+		return false, err
+	}
+	record.Pinned = !record.NotFound && isPinned(key, record)
+	if record.Pinned {
+		if maxVolume := config.Get().MaxPinnedVolume * 1024 * 1024; maxVolume > 0 {
+			// 集計のキーはtxnの外で読む 同時に固定されたものとの兼ね合いで少しはみ出すことはある
+			pinned, err := getSize(pinnedSizeKey)
+			if err != nil {
+				return false, err
+			}
+			if old != nil && old.Pinned {
+				pinned -= old.Size
+			}
+			if pinned+record.Size > maxVolume {
+				record.Pinned = false
+				overBudget = true
 			}
-			count++
-			keys.Add(string(it.Item().Key()))
 		}
-		return nil
-	})
-	return keys, err
+	}
+	bin, err := record.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	if old != nil {
+		if err := unindexLRU(txn, key, old); err != nil {
+			return false, err
+		}
+		if err := unindexExpiry(txn, key, old); err != nil {
+			return false, err
+		}
+		if err := unindexFile(txn, old); err != nil {
+			return false, err
+		}
+	}
+	// 期限はexpiryのインデックスで管理してgcが消すので、badgerのTTLは使わない
+	// TTLで勝手に消えると使用量の集計がずれる
+	if err := txn.Set([]byte(key), bin); err != nil {
+		return false, err
+	}
+	if err := indexLRU(txn, key, record); err != nil {
+		return false, err
+	}
+	if err := indexExpiry(txn, key, record); err != nil {
+		return false, err
+	}
+	if err := indexFile(txn, key, record); err != nil {
+		return false, err
+	}
+	if old != nil && old.BucketName == record.BucketName && old.Pinned == record.Pinned {
+		// 差分だけを足す サイズが変わらなければ何もしない
+		for _, sizeKey := range sizeKeys(record) {
+			if err := addRawSizeTxn(txn, sizeKey, record.Size-old.Size); err != nil {
+				return false, err
+			}
+		}
+		return overBudget, nil
+	}
+	if old != nil {
+		if err := addSizeTxn(txn, old, -1); err != nil {
+			return false, err
+		}
+	}
+	return overBudget, addSizeTxn(txn, record, 1)
 }
 
-// GetCacheFileNames 指定サイズ分のcache file nameを返す
-// size 0なら全て
-func GetCacheFileNames(size int64) (set.Set, error) {
+// DeleteRecord KVSからRecordを消す。キャッシュファイルはgcが後で消す
+func DeleteRecord(key string) error {
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
 
-	var count int64
-	names := set.NewSet()
-
-	err := db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		for it.Rewind(); it.Valid() && (size == 0 || count < size); it.Next() {
-			if it.Item().IsDeletedOrExpired() {
-				continue
-			}
-			count++
-			err := it.Item().Value(func(data []byte) error {
-				record := Record{}
-				err := record.UnmarshalBinary(data)
-				if err != nil {
-					return err
-				}
-				names.Add(record.CacheFileName)
-				return nil
-			})
-			if err != nil {
-				sugar.Errorw("failed to collect file names", "error", err)
-			}
+	err := update(func(txn *badger.Txn) error {
+		record, err := getRecordTxn(txn, key)
+		if err != nil {
+			return err
 		}
-		return nil
+		return deleteRecordTxn(txn, key, record)
 	})
-	return names, err
-}
-
-// DeleteKeysWithSize size分だけキーを適当に消す
-func DeleteKeysWithSize(size int64) error {
-	keys, err := GetKeys(size)
-	if err != nil {
+	if err != nil && err != ErrRecordNotFound {
+		sugar.Errorw("failed to delete record", "error", err)
 		return err
 	}
+	return nil
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		itr := keys.Iterator()
-		for key := range itr.C {
-			if ks, ok := key.(string); ok {
-				txn.Delete([]byte(ks))
-			}
-		}
-		return nil
-	})
-	return err
+// RunGC badgerのGCを走らせる
+func RunGC() error {
+	return db.RunValueLogGC(0.7)
 }
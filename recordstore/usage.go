@@ -0,0 +1,322 @@
+package recordstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// 使用量の集計
+// "!size/total" に全体の、"!size/bucket/" + bucket名 にbucketごとのキャッシュファイルの合計バイト数を保存する
+// 固定したRecordは別の予算で管理するので、"!size/pinned" と "!size/pinned_bucket/" + bucket名 に分けて数える
+// Recordのセット・削除のトランザクションがコミットされたら差分をメモリに貯め、sizeFlushIntervalごとにまとめてKVSに書く
+// 書く前に落ちたぶんは起動時のRebuildUsageで直る
+var sizePrefix = []byte("!size/")
+var totalSizeKey = []byte("!size/total")
+var bucketSizePrefix = []byte("!size/bucket/")
+var pinnedSizeKey = []byte("!size/pinned")
+var pinnedBucketSizePrefix = []byte("!size/pinned_bucket/")
+
+const sizeFlushInterval = time.Second
+
+var (
+	sizeMu sync.Mutex
+	// コミットされてまだKVSに書いていない差分 集計のキー -> バイト数
+	pendingSizes = map[string]int64{}
+	// コミット前のトランザクションごとの差分
+	txnSizes = map[*badger.Txn]map[string]int64{}
+
+	// KVSへの書き込みと、KVSの値と差分を足して読むのが重ならないようにする
+	flushMu   sync.Mutex
+	stopFlush = make(chan struct{})
+)
+
+// Usage キャッシュファイルの合計バイト数
+// Total, Bucketsには固定したRecordのぶんは含まない
+type Usage struct {
+	Total         int64            `json:"total"`
+	Buckets       map[string]int64 `json:"buckets"`
+	Pinned        int64            `json:"pinned"`
+	PinnedBuckets map[string]int64 `json:"pinned_buckets"`
+}
+
+func init() {
+	expvar.Publish("cache_usage", expvar.Func(func() interface{} {
+		usage, err := GetUsage()
+		if err != nil {
+			return nil
+		}
+		return usage
+	}))
+}
+
+func bucketSizeKey(prefix []byte, bucketName string) []byte {
+	return append(append([]byte{}, prefix...), bucketName...)
+}
+
+// recordのサイズを数える集計のキー
+func sizeKeys(record *Record) [][]byte {
+	if record.Pinned {
+		return [][]byte{pinnedSizeKey, bucketSizeKey(pinnedBucketSizePrefix, record.BucketName)}
+	}
+	return [][]byte{totalSizeKey, bucketSizeKey(bucketSizePrefix, record.BucketName)}
+}
+
+func getSizeTxn(txn *badger.Txn, key []byte) (int64, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = item.Value(func(data []byte) error {
+		size = int64(binary.BigEndian.Uint64(data))
+		return nil
+	})
+	return size, err
+}
+
+func setSizeTxn(txn *badger.Txn, key []byte, size int64) error {
+	return txn.Set(key, binary.BigEndian.AppendUint64(nil, uint64(size)))
+}
+
+// txnがコミットされたら集計に足す差分として覚えておく
+// 集計のキーはtxnの中では読み書きしないので、同時の保存・削除が集計のキーで衝突しない
+func addRawSizeTxn(txn *badger.Txn, key []byte, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	sizeMu.Lock()
+	defer sizeMu.Unlock()
+	deltas, ok := txnSizes[txn]
+	if !ok {
+		deltas = map[string]int64{}
+		txnSizes[txn] = deltas
+	}
+	deltas[string(key)] += delta
+	return nil
+}
+
+// recordのサイズのdelta倍を集計に足す
+func addSizeTxn(txn *badger.Txn, record *Record, delta int64) error {
+	for _, key := range sizeKeys(record) {
+		if err := addRawSizeTxn(txn, key, record.Size*delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txnの差分をコミットされていればまだKVSに書いていない差分に移し、されていなければ捨てる
+func finishSizesTxn(txn *badger.Txn, committed bool) {
+	sizeMu.Lock()
+	defer sizeMu.Unlock()
+	deltas := txnSizes[txn]
+	delete(txnSizes, txn)
+	if !committed {
+		return
+	}
+	for key, delta := range deltas {
+		pendingSizes[key] += delta
+	}
+}
+
+// まだKVSに書いていない差分を書く flushMuを取ってから呼ぶ
+func flushSizesLocked() error {
+	sizeMu.Lock()
+	deltas := pendingSizes
+	pendingSizes = map[string]int64{}
+	sizeMu.Unlock()
+	if len(deltas) == 0 {
+		return nil
+	}
+	// 集計のキーに書くのはここだけなので衝突しない
+	err := db.Update(func(txn *badger.Txn) error {
+		for key, delta := range deltas {
+			size, err := getSizeTxn(txn, []byte(key))
+			if err != nil {
+				return err
+			}
+			if err := setSizeTxn(txn, []byte(key), size+delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// 次に書くときまで残しておく
+		sizeMu.Lock()
+		for key, delta := range deltas {
+			pendingSizes[key] += delta
+		}
+		sizeMu.Unlock()
+	}
+	return err
+}
+
+func flushSizes() error {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	return flushSizesLocked()
+}
+
+// sizeFlushIntervalごとに差分をKVSに書く
+func flushSizesPeriodically() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	ticker := time.NewTicker(sizeFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopFlush:
+			return
+		case <-ticker.C:
+			if err := flushSizes(); err != nil {
+				sugar.Errorw("failed to flush cache usage", "error", err)
+			}
+		}
+	}
+}
+
+// KVSの集計とまだ書いていない差分を足した値を返す
+func getSize(key []byte) (int64, error) {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	var size int64
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		size, err = getSizeTxn(txn, key)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	sizeMu.Lock()
+	defer sizeMu.Unlock()
+	return size + pendingSizes[string(key)], nil
+}
+
+// 全ての集計のキーと値を返す
+func getSizesTxn(txn *badger.Txn) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = sizePrefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		size, err := getSizeTxn(txn, it.Item().Key())
+		if err != nil {
+			return nil, err
+		}
+		sizes[string(it.Item().Key())] = size
+	}
+	return sizes, nil
+}
+
+// sizesにまだKVSに書いていない差分を足す
+func addPendingSizes(sizes map[string]int64) {
+	sizeMu.Lock()
+	defer sizeMu.Unlock()
+	for key, delta := range pendingSizes {
+		sizes[key] += delta
+	}
+}
+
+// GetUsage 集計しておいた使用量を返す
+func GetUsage() (*Usage, error) {
+	usage := &Usage{Buckets: map[string]int64{}, PinnedBuckets: map[string]int64{}}
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	err := db.View(func(txn *badger.Txn) error {
+		sizes, err := getSizesTxn(txn)
+		if err != nil {
+			return err
+		}
+		addPendingSizes(sizes)
+		for key, size := range sizes {
+			k := []byte(key)
+			switch {
+			case bytes.Equal(k, totalSizeKey):
+				usage.Total = size
+			case bytes.Equal(k, pinnedSizeKey):
+				usage.Pinned = size
+			case bytes.HasPrefix(k, bucketSizePrefix):
+				usage.Buckets[key[len(bucketSizePrefix):]] = size
+			case bytes.HasPrefix(k, pinnedBucketSizePrefix):
+				usage.PinnedBuckets[key[len(pinnedBucketSizePrefix):]] = size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// RebuildUsage 全てのRecordのサイズを数え直して集計を直す
+// 数えたときのスナップショットでの集計とのずれだけを足すので、数えている間に保存・削除されたぶんも正しく残る
+func RebuildUsage() (*Usage, error) {
+	// 差分を書ききってスナップショットを取る間は書かせない。スナップショットでの集計はKVSの値とまだ書いていない差分の和になる
+	flushMu.Lock()
+	if err := flushSizesLocked(); err != nil {
+		flushMu.Unlock()
+		return nil, err
+	}
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	recorded, err := getSizesTxn(txn)
+	if err != nil {
+		flushMu.Unlock()
+		return nil, err
+	}
+	addPendingSizes(recorded)
+	flushMu.Unlock()
+
+	counted := map[string]int64{}
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if isInternalKey(it.Item().Key()) {
+			continue
+		}
+		var record Record
+		err := it.Item().Value(func(data []byte) error {
+			return record.UnmarshalBinary(data)
+		})
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		if record.NotFound {
+			continue
+		}
+		for _, key := range sizeKeys(&record) {
+			counted[string(key)] += record.Size
+		}
+	}
+	it.Close()
+	for key := range recorded {
+		if _, ok := counted[key]; !ok {
+			counted[key] = 0
+		}
+	}
+	sizeMu.Lock()
+	for key, size := range counted {
+		if size != recorded[key] {
+			pendingSizes[key] += size - recorded[key]
+		}
+	}
+	sizeMu.Unlock()
+	if err := flushSizes(); err != nil {
+		return nil, err
+	}
+	return GetUsage()
+}
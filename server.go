@@ -1,14 +1,17 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 
 	"github.com/nerikeshi-k/mono/config"
 	"github.com/nerikeshi-k/mono/gc"
 	"github.com/nerikeshi-k/mono/handler"
+	"github.com/nerikeshi-k/mono/prefetch"
 	"github.com/nerikeshi-k/mono/recordstore"
 
 	echo "github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 )
 
 func main() {
@@ -23,8 +26,46 @@ func main() {
 	e.Use(serverHeader)
 
 	go gc.Start()
+	go prefetchPins()
 	defer recordstore.Close()
 
+	if config.Get().Admin.Port != 0 {
+		go startAdmin()
+	}
+
 	e.GET("/*", handler.Handle)
 	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", config.Get().Port)))
 }
+
+// 固定したblobを起動時に先読みする
+func prefetchPins() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	pins := []config.Pin{}
+	for _, pin := range recordstore.GetPins() {
+		pins = append(pins, pin.Pin)
+	}
+	jobID := prefetch.StartPins(pins)
+	if jobID != "" {
+		sugar.Infow("started prefetching pinned blobs", "job", jobID)
+	}
+}
+
+// 管理用のエンドポイントを配信とは別のポートで開く
+func startAdmin() {
+	a := echo.New()
+	a.HideBanner = true
+	a.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+	if config.Get().Admin.Token != "" {
+		auth := handler.AdminAuth()
+		a.POST("/purge", handler.Purge, auth)
+		a.POST("/prefetch", handler.StartPrefetch, auth)
+		a.GET("/prefetch/:id", handler.GetPrefetch, auth)
+		a.DELETE("/prefetch/:id", handler.CancelPrefetch, auth)
+		a.GET("/pins", handler.GetPins, auth)
+		a.POST("/pins", handler.AddPin, auth)
+		a.DELETE("/pins", handler.RemovePin, auth)
+	}
+	a.Logger.Fatal(a.Start(fmt.Sprintf(":%d", config.Get().Admin.Port)))
+}
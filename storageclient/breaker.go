@@ -0,0 +1,118 @@
+package storageclient
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"go.uber.org/zap"
+)
+
+const defaultBreakerOpenDuration = 30 * time.Second
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var breakerStates = expvar.NewMap("breaker")
+
+// breaker bucketごとのcircuit breaker
+// originへの失敗がfailure_threshold回続くとopenになり、open_durationの間は即座に失敗させる
+// その後half_openで1件だけ試し、成功すればclosedに戻る
+type breaker struct {
+	mu         sync.Mutex
+	bucketName string
+	state      string
+	failures   int64
+	openedAt   time.Time
+	trying     bool // half_openで試している最中
+	exported   *expvar.String
+}
+
+func newBreaker(bucketName string) *breaker {
+	b := &breaker{
+		bucketName: bucketName,
+		state:      breakerClosed,
+		exported:   new(expvar.String),
+	}
+	b.exported.Set(breakerClosed)
+	breakerStates.Set(bucketName, b.exported)
+	return b
+}
+
+func (b *breaker) openDuration() time.Duration {
+	if config.Get().Breaker.OpenDuration > 0 {
+		return time.Duration(config.Get().Breaker.OpenDuration) * time.Second
+	}
+	return defaultBreakerOpenDuration
+}
+
+func (b *breaker) transit(state string) {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	sugar.Warnw("circuit breaker state changed", "bucket", b.bucketName, "from", b.state, "to", state)
+	b.state = state
+	b.exported.Set(state)
+}
+
+// allow originへのリクエストを通してよければtrue
+func (b *breaker) allow() bool {
+	if config.Get().Breaker.FailureThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openDuration() {
+			return false
+		}
+		b.transit(breakerHalfOpen)
+		b.trying = true
+		return true
+	case breakerHalfOpen:
+		if b.trying {
+			return false
+		}
+		b.trying = true
+		return true
+	default:
+		return true
+	}
+}
+
+// report originへのリクエストの結果を記録する
+func (b *breaker) report(err error) {
+	threshold := config.Get().Breaker.FailureThreshold
+	if threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trying = false
+	if errors.Is(err, context.Canceled) {
+		// 呼び出し側の都合で中断されたので数えない
+		return
+	}
+	if !isRetryable(err) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrOriginTimeout) {
+		// not foundなどはoriginが応答できているので成功とみなす
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transit(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= threshold) {
+		b.openedAt = time.Now()
+		b.transit(breakerOpen)
+	}
+}
@@ -0,0 +1,58 @@
+package storageclient
+
+import (
+	"context"
+	"io"
+)
+
+// chainOrigin 複数のOriginを順に探すOrigin
+// 見つからなかった場合だけ次のOriginを探し、それ以外のエラーはそのまま返す
+type chainOrigin struct {
+	origins []Origin
+}
+
+// Open blobを読むReaderを返す
+func (o *chainOrigin) Open(ctx context.Context, blobName string) (io.ReadCloser, *Attrs, error) {
+	for _, origin := range o.origins {
+		reader, attrs, err := origin.Open(ctx, blobName)
+		if err == ErrBlobNotFound {
+			continue
+		}
+		return reader, attrs, err
+	}
+	return nil, nil, ErrBlobNotFound
+}
+
+// Stat blobのメタ情報を返す
+func (o *chainOrigin) Stat(ctx context.Context, blobName string) (*Attrs, error) {
+	for _, origin := range o.origins {
+		attrs, err := origin.Stat(ctx, blobName)
+		if err == ErrBlobNotFound {
+			continue
+		}
+		return attrs, err
+	}
+	return nil, ErrBlobNotFound
+}
+
+// List prefixから始まるblob名の一覧を全てのOriginから集めて返す
+func (o *chainOrigin) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, origin := range o.origins {
+		list, err := origin.List(ctx, prefix)
+		if err == ErrListNotSupported {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
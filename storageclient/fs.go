@@ -0,0 +1,166 @@
+package storageclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/util"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// fsOrigin ローカルディスクのディレクトリを取得元とするOrigin
+type fsOrigin struct {
+	root string
+}
+
+func newFSOrigin(conf config.Origin) (*fsOrigin, error) {
+	if conf.Root == "" {
+		return nil, fmt.Errorf("root is required for fs origin")
+	}
+	root, err := filepath.Abs(conf.Root)
+	if err != nil {
+		return nil, err
+	}
+	// blobのパスはシンボリックリンクをたどってから比べるので、rootもたどっておく
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &fsOrigin{root: root}, nil
+}
+
+// blob名をroot以下のパスに変換する。rootの外を指す名前は見つからなかった扱いにする
+// root内のシンボリックリンクはたどり、たどった先がrootの外ならやはり見つからなかった扱いにする
+func (o *fsOrigin) resolve(blobName string) (string, error) {
+	for _, segment := range strings.Split(blobName, "/") {
+		if segment == ".." {
+			return "", ErrBlobNotFound
+		}
+	}
+	cleaned := path.Clean("/" + blobName)
+	if cleaned == "/" {
+		return "", ErrBlobNotFound
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(o.root, filepath.FromSlash(cleaned)))
+	if err != nil {
+		return "", convertFSError(err)
+	}
+	rel, err := filepath.Rel(o.root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrBlobNotFound
+	}
+	return resolved, nil
+}
+
+func convertFSError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func fileAttrs(blobName string, info fs.FileInfo) *Attrs {
+	contentType := util.PredictContentType(blobName)
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	return &Attrs{
+		Size:         info.Size(),
+		ContentType:  contentType,
+		LastModified: info.ModTime(),
+	}
+}
+
+// Open blobを読むReaderを返す
+func (o *fsOrigin) Open(ctx context.Context, blobName string) (io.ReadCloser, *Attrs, error) {
+	p, err := o.resolve(blobName)
+	if err != nil {
+		return nil, nil, err
+	}
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, nil, convertFSError(err)
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		fp.Close()
+		return nil, nil, ErrBlobNotFound
+	}
+	return fp, fileAttrs(blobName, info), nil
+}
+
+// Stat blobのメタ情報を返す
+func (o *fsOrigin) Stat(ctx context.Context, blobName string) (*Attrs, error) {
+	p, err := o.resolve(blobName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, convertFSError(err)
+	}
+	if info.IsDir() {
+		return nil, ErrBlobNotFound
+	}
+	return fileAttrs(blobName, info), nil
+}
+
+// List prefixから始まるblob名の一覧を返す
+func (o *fsOrigin) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	// prefixが含むディレクトリ以下だけを走査する
+	dir := o.root
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		p, err := o.resolve(prefix[:i])
+		if err != nil {
+			return names, nil
+		}
+		dir = p
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(o.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
@@ -0,0 +1,95 @@
+package storageclient
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nerikeshi-k/mono/config"
+)
+
+func TestFSOriginStat(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	mustWriteFile(t, filepath.Join(root, "a.png"), "a")
+	mustWriteFile(t, filepath.Join(root, "sub", "b.png"), "bb")
+	mustWriteFile(t, filepath.Join(dir, "secret.png"), "secret")
+	mustWriteFile(t, filepath.Join(dir, "root-sibling", "c.png"), "ccc")
+	if err := os.Symlink(filepath.Join(dir, "secret.png"), filepath.Join(root, "escape.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub", "b.png"), filepath.Join(root, "inside.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	origin, err := newFSOrigin(fsConf(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rootが"/"でもroot以下のblobを取得できる
+	slashRoot, err := newFSOrigin(fsConf("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		origin   *fsOrigin
+		blobName string
+		size     int64 // 0なら見つからない
+	}{
+		{"file", origin, "a.png", 1},
+		{"file in dir", origin, "sub/b.png", 2},
+		{"symlink inside root", origin, "inside.png", 2},
+		{"dot segment", origin, "./sub/./b.png", 2},
+		{"parent", origin, "../secret.png", 0},
+		{"parent in the middle", origin, "sub/../../secret.png", 0},
+		{"parent within root", origin, "sub/../a.png", 0},
+		{"encoded parent", origin, "%2e%2e/secret.png", 0},
+		{"encoded slash", origin, "..%2fsecret.png", 0},
+		{"sibling with root as prefix", origin, "../root-sibling/c.png", 0},
+		{"symlink out of root", origin, "escape.png", 0},
+		{"directory", origin, "sub", 0},
+		{"root", origin, "", 0},
+		{"missing file", origin, "missing.png", 0},
+		{"missing dir", origin, "missing/a.png", 0},
+		{"slash root", slashRoot, strings.TrimPrefix(filepath.ToSlash(resolvedRoot), "/") + "/a.png", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs, err := tt.origin.Stat(context.Background(), tt.blobName)
+			if tt.size == 0 {
+				if err != ErrBlobNotFound {
+					t.Fatalf("Stat(%q) error = %v, want %v", tt.blobName, err, ErrBlobNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Stat(%q) error = %v", tt.blobName, err)
+			}
+			if attrs.Size != tt.size {
+				t.Errorf("Stat(%q) size = %d, want %d", tt.blobName, attrs.Size, tt.size)
+			}
+		})
+	}
+}
+
+func fsConf(root string) config.Origin {
+	return config.Origin{Type: "fs", Root: root}
+}
+
+func mustWriteFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,74 +1,153 @@
 package storageclient
 
 import (
-	"errors"
+	"context"
 	"io"
+	"net/url"
+	"sync"
 
 	"cloud.google.com/go/storage"
-	"go.uber.org/zap"
-	"golang.org/x/net/context"
+	"github.com/nerikeshi-k/mono/config"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
-var ctx context.Context
-var googleCloudStorageClient *storage.Client
-
-// Meta fetchが返却する構造体
-type Meta struct {
-	Data        []byte
-	Size        int64
-	ContentType string
+// 接続設定が同じbucket同士でclientを共有する
+type gcsClientKey struct {
+	credentialsFile string
+	endpoint        string
+	anonymous       bool
 }
 
 var (
-	// ErrBucketNotFound bucketが見つからなかった
-	ErrBucketNotFound = errors.New("bucket not found")
-
-	// ErrBlobNotFound blobが見つからなかった
-	ErrBlobNotFound = errors.New("blob not found")
+	googleCloudStorageClients   = map[gcsClientKey]*storage.Client{}
+	googleCloudStorageClientsMu sync.Mutex
 )
 
-func init() {
-	sugar := zap.NewExample().Sugar()
-	defer sugar.Sync()
+func getGoogleCloudStorageClient(key gcsClientKey) (*storage.Client, error) {
+	googleCloudStorageClientsMu.Lock()
+	defer googleCloudStorageClientsMu.Unlock()
 
-	ctx = context.Background() // グローバルのctxに代入
-	client, err := storage.NewClient(ctx)
+	if client, ok := googleCloudStorageClients[key]; ok {
+		return client, nil
+	}
+	opts := []option.ClientOption{}
+	if key.credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(key.credentialsFile))
+	}
+	if key.anonymous {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	if key.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(key.endpoint))
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
 	if err != nil {
-		sugar.Fatalw("Failed to create client", "error", err)
+		return nil, err
 	}
-	googleCloudStorageClient = client
+	googleCloudStorageClients[key] = client
+	return client, nil
 }
 
-// FetchBlob bucketNameのbucketからblobNameのblobを取ってきてMetaの形で返す
-func FetchBlob(bucketName string, blobName string) (*Meta, error) {
-	bucket := googleCloudStorageClient.Bucket(bucketName)
-
-	blob := bucket.Object(blobName)
-	reader, err := blob.NewReader(ctx)
+// "http://localhost:4443" のようにパスが省略されていたらJSON APIのパスを補う
+func normalizeGCSEndpoint(endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		switch err {
-		case storage.ErrBucketNotExist:
-			return nil, ErrBucketNotFound
-		case storage.ErrObjectNotExist:
-			return nil, ErrBlobNotFound
-		default:
-			return nil, err
-		}
+		return "", err
 	}
-	defer reader.Close()
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/storage/v1/"
+	}
+	return u.String(), nil
+}
 
-	blobAttrs, err := blob.Attrs(ctx)
+// gcsOrigin Google Cloud Storageのbucketを取得元とするOrigin
+type gcsOrigin struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSOrigin(conf config.Origin) (*gcsOrigin, error) {
+	endpoint, err := normalizeGCSEndpoint(conf.Endpoint)
 	if err != nil {
 		return nil, err
 	}
-	data, err := io.ReadAll(reader)
+	client, err := getGoogleCloudStorageClient(gcsClientKey{
+		credentialsFile: conf.CredentialsFile,
+		endpoint:        endpoint,
+		anonymous:       conf.Anonymous,
+	})
 	if err != nil {
 		return nil, err
 	}
-	meta := Meta{
-		Data:        data,
-		Size:        blobAttrs.Size,
-		ContentType: blobAttrs.ContentType,
+	// リトライはwithRetryで行う
+	handle := client.Bucket(conf.Bucket).Retryer(storage.WithPolicy(storage.RetryNever))
+	if conf.Project != "" {
+		handle = handle.UserProject(conf.Project)
+	}
+	return &gcsOrigin{bucket: handle}, nil
+}
+func convertGCSError(err error) error {
+	switch err {
+	case storage.ErrBucketNotExist:
+		return ErrBucketNotFound
+	case storage.ErrObjectNotExist:
+		return ErrBlobNotFound
+	default:
+		return err
+	}
+}
+
+// Open blobを読むReaderを返す
+func (o *gcsOrigin) Open(ctx context.Context, blobName string) (io.ReadCloser, *Attrs, error) {
+	reader, err := o.bucket.Object(blobName).NewReader(ctx)
+	if err != nil {
+		return nil, nil, convertGCSError(err)
+	}
+	attrs := &Attrs{
+		Size:           reader.Attrs.Size,
+		ContentType:    reader.Attrs.ContentType,
+		LastModified:   reader.Attrs.LastModified,
+		Generation:     reader.Attrs.Generation,
+		Metageneration: reader.Attrs.Metageneration,
+		CacheControl:   reader.Attrs.CacheControl,
+	}
+	return reader, attrs, nil
+}
+
+// Stat blobのメタ情報を返す
+func (o *gcsOrigin) Stat(ctx context.Context, blobName string) (*Attrs, error) {
+	blobAttrs, err := o.bucket.Object(blobName).Attrs(ctx)
+	if err != nil {
+		return nil, convertGCSError(err)
+	}
+	attrs := &Attrs{
+		Size:           blobAttrs.Size,
+		ContentType:    blobAttrs.ContentType,
+		ETag:           blobAttrs.Etag,
+		LastModified:   blobAttrs.Updated,
+		Generation:     blobAttrs.Generation,
+		Metageneration: blobAttrs.Metageneration,
+		CacheControl:   blobAttrs.CacheControl,
+	}
+	return attrs, nil
+}
+
+// List prefixから始まるblob名の一覧を返す
+func (o *gcsOrigin) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	it := o.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		blobAttrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, convertGCSError(err)
+		}
+		names = append(names, blobAttrs.Name)
 	}
-	return &meta, nil
+	return names, nil
 }
@@ -0,0 +1,184 @@
+package storageclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/util"
+	"golang.org/x/exp/slices"
+)
+
+const defaultHTTPOriginTimeout = 30 * time.Second
+const maxHTTPOriginRedirects = 5
+
+// HTTPStatusError 上流のwebサーバーが想定外のステータスを返した
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("upstream responded %d", e.StatusCode)
+}
+
+// httpOrigin 上流のwebサーバーを取得元とするOrigin
+type httpOrigin struct {
+	client      *http.Client
+	baseURL     *url.URL
+	maxBodySize int64
+}
+
+func isAllowedHost(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return slices.Contains(config.Get().HTTPOrigin.AllowedHosts, u.Hostname())
+}
+
+func newHTTPOrigin(conf config.Origin) (*httpOrigin, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(conf.BaseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if !isAllowedHost(baseURL) {
+		return nil, fmt.Errorf("%s is not in http_origin.allowed_hosts", conf.BaseURL)
+	}
+	timeout := defaultHTTPOriginTimeout
+	if config.Get().HTTPOrigin.Timeout > 0 {
+		timeout = time.Duration(config.Get().HTTPOrigin.Timeout) * time.Second
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		// リダイレクト先も許可されたホストに限る
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxHTTPOriginRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxHTTPOriginRedirects)
+			}
+			if !isAllowedHost(req.URL) {
+				return fmt.Errorf("%w: %s", ErrRedirectNotAllowed, req.URL.Host)
+			}
+			return nil
+		},
+	}
+	return &httpOrigin{
+		client:      client,
+		baseURL:     baseURL,
+		maxBodySize: config.Get().HTTPOrigin.MaxBodySize,
+	}, nil
+}
+
+// blob名からURLを組み立てる
+func (o *httpOrigin) blobURL(blobName string) (string, error) {
+	segments := strings.Split(blobName, "/")
+	for i, segment := range segments {
+		if segment == ".." || segment == "." {
+			return "", ErrBlobNotFound
+		}
+		segments[i] = url.PathEscape(segment)
+	}
+	return o.baseURL.String() + "/" + strings.Join(segments, "/"), nil
+}
+
+func (o *httpOrigin) do(ctx context.Context, method string, blobName string) (*http.Response, error) {
+	u, err := o.blobURL(blobName)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		res.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, &HTTPStatusError{StatusCode: res.StatusCode}
+	}
+	if o.maxBodySize > 0 && res.ContentLength > o.maxBodySize {
+		res.Body.Close()
+		return nil, ErrBlobTooLarge
+	}
+	return res, nil
+}
+
+func responseAttrs(blobName string, res *http.Response) *Attrs {
+	// Content-Typeを返さないwebサーバーもあるので、無ければfsと同じく拡張子から推測する
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = util.PredictContentType(blobName)
+	}
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	attrs := &Attrs{
+		Size:         res.ContentLength,
+		ContentType:  contentType,
+		ETag:         res.Header.Get("ETag"),
+		CacheControl: res.Header.Get("Cache-Control"),
+	}
+	if lastModified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		attrs.LastModified = lastModified
+	}
+	return attrs
+}
+
+// Open blobを読むReaderを返す
+func (o *httpOrigin) Open(ctx context.Context, blobName string) (io.ReadCloser, *Attrs, error) {
+	res, err := o.do(ctx, http.MethodGet, blobName)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := res.Body
+	if o.maxBodySize > 0 {
+		body = &limitedReadCloser{ReadCloser: res.Body, remaining: o.maxBodySize}
+	}
+	return body, responseAttrs(blobName, res), nil
+}
+
+// Stat blobのメタ情報を返す
+func (o *httpOrigin) Stat(ctx context.Context, blobName string) (*Attrs, error) {
+	res, err := o.do(ctx, http.MethodHead, blobName)
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusMethodNotAllowed || statusErr.StatusCode == http.StatusNotImplemented) {
+		// HEADに対応していないwebサーバーではメタ情報が分からないものとして扱う
+		return &Attrs{Size: -1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return responseAttrs(blobName, res), nil
+}
+
+// List webサーバーからは一覧を取れない
+func (o *httpOrigin) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, ErrListNotSupported
+}
+
+// limitedReadCloser remainingバイトを超えて読もうとするとErrBlobTooLargeを返す
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, ErrBlobTooLarge
+	}
+	return n, err
+}
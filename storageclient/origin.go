@@ -0,0 +1,279 @@
+package storageclient
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/nerikeshi-k/mono/config"
+	"github.com/nerikeshi-k/mono/util"
+	"go.uber.org/zap"
+)
+
+// Origin blobの取得元
+type Origin interface {
+	// Open blobを読むReaderとblobのメタ情報を返す
+	Open(ctx context.Context, blobName string) (io.ReadCloser, *Attrs, error)
+	// Stat blobのメタ情報を返す
+	Stat(ctx context.Context, blobName string) (*Attrs, error)
+	// List prefixから始まるblob名の一覧を返す
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Attrs blobのメタ情報
+type Attrs struct {
+	Size           int64
+	ContentType    string
+	ETag           string
+	LastModified   time.Time
+	Generation     int64  // gcsのみ
+	Metageneration int64  // gcsのみ
+	CacheControl   string // originのblobに設定されたCache-Control fsでは空
+}
+
+// Meta fetchが返却する構造体
+type Meta struct {
+	Size           int64
+	ContentType    string
+	ETag           string
+	LastModified   time.Time
+	Generation     int64
+	Metageneration int64
+	Checksum       uint32 // 書き込んだ内容のcrc32 (Castagnoli)
+	CacheControl   string
+}
+
+var (
+	// ErrBucketNotFound bucketが見つからなかった
+	ErrBucketNotFound = errors.New("bucket not found")
+
+	// ErrBlobNotFound blobが見つからなかった
+	ErrBlobNotFound = errors.New("blob not found")
+
+	// ErrBlobTooLarge blobが上限サイズを超えていた
+	ErrBlobTooLarge = errors.New("blob too large")
+
+	// ErrListNotSupported Originが一覧の取得に対応していない
+	ErrListNotSupported = errors.New("list not supported")
+
+	// ErrCircuitOpen originへの失敗が続いているので取得を止めている
+	ErrCircuitOpen = errors.New("circuit open")
+
+	// ErrCacheWrite キャッシュファイルへの書き込みに失敗した originのせいではない
+	ErrCacheWrite = errors.New("failed to write cache file")
+
+	// ErrRedirectNotAllowed http_origin.allowed_hostsに無いホストへリダイレクトされた
+	ErrRedirectNotAllowed = errors.New("redirect not allowed")
+
+	// ErrOriginTimeout originのクライアント自身のタイムアウト(http_origin.timeoutなど)で取得が終わった
+	ErrOriginTimeout = errors.New("origin timeout")
+)
+
+var (
+	// bucket名 -> Origin
+	origins = map[string]Origin{}
+	// bucket名 -> breaker
+	breakers = map[string]*breaker{}
+
+	stats = expvar.NewMap("storageclient")
+)
+
+func init() {
+	sugar := zap.NewExample().Sugar()
+	defer sugar.Sync()
+
+	for _, bucket := range config.Get().Buckets {
+		origin, err := newBucketOrigin(bucket)
+		if err != nil {
+			sugar.Fatalw("Failed to create origin", "bucket", bucket.Name, "error", err)
+		}
+		origins[bucket.Name] = origin
+		breakers[bucket.Name] = newBreaker(bucket.Name)
+	}
+}
+
+func newBucketOrigin(bucket config.Bucket) (Origin, error) {
+	if len(bucket.Origins) == 0 {
+		return newOrigin(bucket.Name, bucket.Origin)
+	}
+	chain := &chainOrigin{}
+	for _, conf := range bucket.Origins {
+		origin, err := newOrigin(bucket.Name, conf)
+		if err != nil {
+			return nil, err
+		}
+		chain.origins = append(chain.origins, origin)
+	}
+	return chain, nil
+}
+
+func newOrigin(bucketName string, conf config.Origin) (Origin, error) {
+	if conf.Bucket == "" {
+		conf.Bucket = bucketName
+	}
+	switch conf.Type {
+	case "", "gcs":
+		return newGCSOrigin(conf)
+	case "fs":
+		return newFSOrigin(conf)
+	case "s3":
+		return newS3Origin(conf)
+	case "http":
+		return newHTTPOrigin(conf)
+	default:
+		return nil, fmt.Errorf("unknown origin type: %s", conf.Type)
+	}
+}
+
+// GetOrigin bucketNameに対応するOriginを返す
+func GetOrigin(bucketName string) (Origin, error) {
+	origin, ok := origins[bucketName]
+	if !ok {
+		return nil, ErrBucketNotFound
+	}
+	return origin, nil
+}
+
+// originへの操作をcircuit breakerとリトライを通して行う
+func call(ctx context.Context, bucketName string, op func(origin Origin) error) error {
+	origin, err := GetOrigin(bucketName)
+	if err != nil {
+		return err
+	}
+	b := breakers[bucketName]
+	if !b.allow() {
+		stats.Add("breaker_rejections", 1)
+		return ErrCircuitOpen
+	}
+	err = withRetry(ctx, func() error {
+		return op(origin)
+	})
+	if ctx.Err() == nil && isTimeout(err) {
+		err = fmt.Errorf("%w: %w", ErrOriginTimeout, err)
+	}
+	if err != nil && ctx.Err() != nil {
+		// タイムアウトでエラーの中身がわからなくなっていることがあるので、ctxの方で判断させる
+		b.report(ctx.Err())
+	} else {
+		b.report(err)
+	}
+	return err
+}
+
+// originのクライアントがタイムアウトしたエラーならtrue
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// StatBlob bucketNameのbucketにあるblobNameのblobのメタ情報を返す
+func StatBlob(ctx context.Context, bucketName string, blobName string) (*Attrs, error) {
+	var attrs *Attrs
+	err := call(ctx, bucketName, func(origin Origin) error {
+		var err error
+		attrs, err = origin.Stat(ctx, blobName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// ListBlobs bucketNameのbucketでprefixから始まるblob名の一覧を返す
+func ListBlobs(ctx context.Context, bucketName string, prefix string) ([]string, error) {
+	var names []string
+	err := call(ctx, bucketName, func(origin Origin) error {
+		var err error
+		names, err = origin.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// FetchBlob bucketNameのbucketからblobNameのblobを取ってきてfpに書き込み、Metaの形で返す
+// max_blob_sizeを超えるblobはErrBlobTooLargeになる。途中まで書き込まれたfpの後始末は呼び出し側で行う
+// 一時的な失敗はfpを空にしてリトライする
+func FetchBlob(ctx context.Context, bucketName string, blobName string, fp *os.File) (*Meta, error) {
+	var meta *Meta
+	attempt := 0
+	err := call(ctx, bucketName, func(origin Origin) error {
+		if attempt > 0 {
+			if err := fp.Truncate(0); err != nil {
+				return fmt.Errorf("%w: %w", ErrCacheWrite, err)
+			}
+			if _, err := fp.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("%w: %w", ErrCacheWrite, err)
+			}
+		}
+		attempt++
+		var err error
+		meta, err = fetchBlob(ctx, origin, blobName, fp)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func fetchBlob(ctx context.Context, origin Origin, blobName string, w io.Writer) (*Meta, error) {
+	maxBlobSize := config.Get().MaxBlobSize
+
+	reader, attrs, err := origin.Open(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// bodyを読み始める前にメタ情報のサイズを確かめる
+	if maxBlobSize > 0 && attrs.Size > maxBlobSize {
+		return nil, ErrBlobTooLarge
+	}
+	// サイズが不明(-1)なこともあるので、書き込みながらも確かめる
+	hasher := crc32.New(util.ChecksumTable)
+	size, err := io.Copy(&limitedWriter{Writer: io.MultiWriter(w, hasher), limit: maxBlobSize}, reader)
+	if err != nil {
+		return nil, err
+	}
+	meta := Meta{
+		Size:           size,
+		ContentType:    attrs.ContentType,
+		ETag:           attrs.ETag,
+		LastModified:   attrs.LastModified,
+		Generation:     attrs.Generation,
+		Metageneration: attrs.Metageneration,
+		Checksum:       hasher.Sum32(),
+		CacheControl:   attrs.CacheControl,
+	}
+	return &meta, nil
+}
+
+// limitedWriter limitバイトを超えて書き込もうとするとErrBlobTooLargeを返す。limitが0なら無制限
+// 書き込み先のエラーはErrCacheWriteで包んで、originからの読み込みのエラーと区別する
+type limitedWriter struct {
+	io.Writer
+	limit   int64
+	written int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.written+int64(len(p)) > w.limit {
+		return 0, ErrBlobTooLarge
+	}
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("%w: %w", ErrCacheWrite, err)
+	}
+	return n, nil
+}
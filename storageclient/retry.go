@@ -0,0 +1,100 @@
+package storageclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/nerikeshi-k/mono/config"
+	"google.golang.org/api/googleapi"
+)
+
+const defaultRetryMaxAttempts = 3
+const defaultRetryInitialBackoff = 100 * time.Millisecond
+const defaultRetryMaxBackoff = 2 * time.Second
+
+// 一時的な失敗で、やり直せば成功しうるエラーならtrue
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch {
+	case errors.Is(err, ErrBlobNotFound),
+		errors.Is(err, ErrBucketNotFound),
+		errors.Is(err, ErrBlobTooLarge),
+		errors.Is(err, ErrListNotSupported),
+		errors.Is(err, ErrCircuitOpen),
+		errors.Is(err, ErrCacheWrite),
+		errors.Is(err, ErrRedirectNotAllowed),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	if isTimeout(err) {
+		// タイムアウトまで待ったものをやり直すと、呼び出し側をさらに待たせてしまう
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.Code)
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		return isRetryableStatus(s3Err.StatusCode)
+	}
+	// 接続エラーなど
+	return true
+}
+
+func isRetryableStatus(code int) bool {
+	return code == 429 || code >= 500
+}
+
+// n回目のリトライ前に待つ時間 (exponential backoff, full jitter)
+func backoff(n int) time.Duration {
+	initial := defaultRetryInitialBackoff
+	if config.Get().Retry.InitialBackoff > 0 {
+		initial = time.Duration(config.Get().Retry.InitialBackoff) * time.Millisecond
+	}
+	max := defaultRetryMaxBackoff
+	if config.Get().Retry.MaxBackoff > 0 {
+		max = time.Duration(config.Get().Retry.MaxBackoff) * time.Millisecond
+	}
+	d := initial << n
+	if d <= 0 || d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryableなエラーの間、設定された回数までopを繰り返す
+func withRetry(ctx context.Context, op func() error) error {
+	maxAttempts := int(config.Get().Retry.MaxAttempts)
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			stats.Add("retries", 1)
+			timer := time.NewTimer(backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		err = op()
+		if !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package storageclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nerikeshi-k/mono/config"
+)
+
+func init() {
+	// リトライはwithRetryで行う
+	minio.MaxRetry = 1
+}
+
+// s3Origin S3互換ストレージ(AWS, MinIO, Ceph RGWなど)のbucketを取得元とするOrigin
+type s3Origin struct {
+	client     *minio.Client
+	bucketName string
+}
+
+func newS3Origin(conf config.Origin) (*s3Origin, error) {
+	if conf.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required for s3 origin")
+	}
+	// スキームつきで書かれていたらそれに従う
+	endpoint := conf.Endpoint
+	secure := !conf.Insecure
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		endpoint = u.Host
+		secure = u.Scheme == "https"
+	}
+
+	var creds *credentials.Credentials
+	if conf.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(conf.AccessKeyID, conf.SecretAccessKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{},
+		})
+	}
+	lookup := minio.BucketLookupAuto
+	if conf.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       conf.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Origin{client: client, bucketName: conf.Bucket}, nil
+}
+
+func convertS3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchBucket":
+		return ErrBucketNotFound
+	case "NoSuchKey":
+		return ErrBlobNotFound
+	default:
+		return err
+	}
+}
+
+func objectAttrs(info minio.ObjectInfo) *Attrs {
+	return &Attrs{
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		CacheControl: info.Metadata.Get("Cache-Control"),
+	}
+}
+
+// Open blobを読むReaderを返す
+func (o *s3Origin) Open(ctx context.Context, blobName string) (io.ReadCloser, *Attrs, error) {
+	object, err := o.client.GetObject(ctx, o.bucketName, blobName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, convertS3Error(err)
+	}
+	// GetObjectはリクエストを遅延させるので、Statで存在を確かめる
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, nil, convertS3Error(err)
+	}
+	return object, objectAttrs(info), nil
+}
+
+// Stat blobのメタ情報を返す
+func (o *s3Origin) Stat(ctx context.Context, blobName string) (*Attrs, error) {
+	info, err := o.client.StatObject(ctx, o.bucketName, blobName, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, convertS3Error(err)
+	}
+	return objectAttrs(info), nil
+}
+
+// List prefixから始まるblob名の一覧を返す
+func (o *s3Origin) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	for info := range o.client.ListObjects(ctx, o.bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, convertS3Error(info.Err)
+		}
+		names = append(names, info.Key)
+	}
+	return names, nil
+}
@@ -1,48 +1,37 @@
 package util
 
 import (
+	"hash/crc32"
 	"os"
-	"path/filepath"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
+// ChecksumTable キャッシュファイルのchecksumに使うcrc32のテーブル (Castagnoli)
+var ChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 // DoesFileExist ファイルの存在を調べる。あればtrue, なければfalse
 func DoesFileExist(filename string) bool {
 	_, err := os.Stat(filename)
 	return err == nil
 }
 
-// ListDir 与えられたパスのディレクトリのファイル一覧を返す
-func ListDir(dir string) ([]string, error) {
-	filenames := []string{}
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		return filenames, err
-	}
-	for _, file := range files {
-		filenames = append(filenames, file.Name())
-	}
-	return filenames, nil
-}
-
-// GetDirSizeMB 指定ディレクトリのサイズをMB単位で返す
-func GetDirSizeMB(path string) float64 {
-	// from https://stackoverflow.com/questions/32482673/golang-how-to-get-directory-total-size
-	var dirSize int64
-	readSize := func(path string, file os.FileInfo, err error) error {
-		if !file.IsDir() {
-			dirSize += file.Size()
-		}
-		return nil
-	}
-	filepath.Walk(path, readSize)
-	sizeMB := float64(dirSize) / 1024.0 / 1024.0
-	return sizeMB
-}
-
 // GenerateUUID UUID文字列を返す
 func GenerateUUID() string {
 	uuid := uuid.New()
 	return uuid.String()
 }
+
+// PredictContentType 拡張子からContentTypeを推測する。わからなければ空文字を返す
+func PredictContentType(name string) string {
+	if strings.HasSuffix(name, ".png") {
+		return "image/png"
+	} else if strings.HasSuffix(name, ".jpeg") || strings.HasSuffix(name, ".jpg") {
+		return "image/jpeg"
+	} else if strings.HasSuffix(name, ".webp") {
+		return "image/webp"
+	} else {
+		return ""
+	}
+}